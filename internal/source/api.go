@@ -0,0 +1,252 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/pkgsite/internal/derrors"
+	"golang.org/x/pkgsite/internal/log"
+)
+
+// This file holds code that calls the APIs of repo hosting sites.
+
+const defaultGitHubAPIURL = "https://api.github.com"
+
+// A CommitResolver finds the commits that refs of a repo refer to. The
+// default one, used unless Options.CommitResolver is set, calls the API of
+// the repo's host, or requests its web pages.
+type CommitResolver interface {
+	// ResolveTag returns the ID of the commit that tag refers to in the
+	// repo described by info.
+	ResolveTag(ctx context.Context, info *Info, tag string) (string, error)
+	// DefaultBranch returns the name of the default branch of the repo
+	// described by info.
+	DefaultBranch(ctx context.Context, info *Info) (string, error)
+}
+
+// commitResolver returns the CommitResolver configured for c, or the default
+// one.
+func (c *Client) commitResolver() CommitResolver {
+	if c.opts.CommitResolver != nil {
+		return c.opts.CommitResolver
+	}
+	return httpResolver{c}
+}
+
+// httpResolver is the default CommitResolver.
+type httpResolver struct {
+	c *Client
+}
+
+func (r httpResolver) ResolveTag(ctx context.Context, info *Info, tag string) (string, error) {
+	return r.c.commitForTag(ctx, info, tag)
+}
+
+func (r httpResolver) DefaultBranch(ctx context.Context, info *Info) (string, error) {
+	branch, err := r.c.defaultBranchFromAPI(ctx, info)
+	if err != nil {
+		log.Infof(ctx, "default branch of %q from API: %v; guessing", info.repoURL, err)
+		return r.c.guessDefaultBranch(ctx, info)
+	}
+	return branch, nil
+}
+
+// DefaultBranch returns the name of the default branch of the repo described
+// by info.
+//
+// If a token is configured for the repo's host, DefaultBranch asks the host's
+// API. Otherwise, or if the API call fails, it guesses by checking for a
+// "main" branch, then a "master" branch. If c has a CommitResolver, it is
+// asked instead. Results are cached by repo URL.
+func (c *Client) DefaultBranch(ctx context.Context, info *Info) (_ string, err error) {
+	defer derrors.Wrap(&err, "DefaultBranch(ctx, %q)", info.RepoURL())
+
+	if info == nil || info.repoURL == "" {
+		return "", fmt.Errorf("no repo: %w", derrors.InvalidArgument)
+	}
+	st := c.state()
+	st.mu.Lock()
+	branch, ok := st.branchesByURL[info.repoURL]
+	st.mu.Unlock()
+	if ok {
+		return branch, nil
+	}
+	branch, err = c.commitResolver().DefaultBranch(ctx, info)
+	if err != nil {
+		return "", err
+	}
+	st.mu.Lock()
+	if st.branchesByURL == nil {
+		st.branchesByURL = map[string]string{}
+	}
+	st.branchesByURL[info.repoURL] = branch
+	st.mu.Unlock()
+	return branch, nil
+}
+
+// BranchURL returns a URL for the module's directory at the tip of the
+// default branch of its repo. A pseudo-version does not record the branch of
+// its commit, so this is also the URL to use for the latest code on the branch
+// of a pseudo-version.
+func (c *Client) BranchURL(ctx context.Context, info *Info) (string, error) {
+	branch, err := c.DefaultBranch(ctx, info)
+	if err != nil {
+		return "", err
+	}
+	i := *info
+	i.commit = branch
+	i.refKind = branchRef
+	return i.ModuleURL(), nil
+}
+
+// defaultBranchFromAPI asks the API of the repo's host for the repo's default
+// branch. It fails if no token is configured for the host.
+func (c *Client) defaultBranchFromAPI(ctx context.Context, info *Info) (string, error) {
+	api, err := c.projectAPI(info)
+	if err != nil {
+		return "", err
+	}
+	var repo struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := c.getJSON(ctx, api.url, api.header, api.value, &repo); err != nil {
+		return "", err
+	}
+	if repo.DefaultBranch == "" {
+		return "", fmt.Errorf("%s: no default branch", api.url)
+	}
+	return repo.DefaultBranch, nil
+}
+
+// commitForTag asks the API of the repo's host for the ID of the commit that
+// tag refers to. It fails if no token is configured for the host.
+func (c *Client) commitForTag(ctx context.Context, info *Info, tag string) (_ string, err error) {
+	defer derrors.Wrap(&err, "commitForTag(ctx, %q, %q)", info.repoURL, tag)
+
+	api, err := c.projectAPI(info)
+	if err != nil {
+		return "", err
+	}
+	var commit struct {
+		SHA string `json:"sha"` // GitHub
+		ID  string `json:"id"`  // GitLab
+	}
+	if err := c.getJSON(ctx, api.url+api.commitPath+api.escapeRef(tag), api.header, api.value, &commit); err != nil {
+		return "", err
+	}
+	if commit.SHA != "" {
+		return commit.SHA, nil
+	}
+	if commit.ID != "" {
+		return commit.ID, nil
+	}
+	return "", fmt.Errorf("no commit ID: %w", derrors.NotFound)
+}
+
+// An apiInfo describes how to call the API of a repo's host for a repo.
+type apiInfo struct {
+	url           string              // URL of the repo in the API
+	commitPath    string              // path relative to url of a commit, given a ref
+	escapeRef     func(string) string // escapes a ref for commitPath
+	header, value string              // HTTP header for authentication, and its value
+}
+
+// projectAPI returns information for calling the API of the host of the repo
+// described by info. It fails if the host is not a known one, or no token is
+// configured for it.
+func (c *Client) projectAPI(info *Info) (*apiInfo, error) {
+	u, err := url.Parse(info.repoURL)
+	if err != nil {
+		return nil, err
+	}
+	project := strings.Trim(u.Path, "/")
+	var (
+		api   apiInfo
+		token string
+	)
+	switch info.templates {
+	case githubURLTemplates:
+		base := c.githubAPIURL
+		if base == "" {
+			base = defaultGitHubAPIURL
+		}
+		token = c.opts.GitHubToken
+		// Refs like "dir/v1.2.3" keep their slashes.
+		api = apiInfo{
+			url:        base + "/repos/" + project,
+			commitPath: "/commits/",
+			escapeRef:  escapePath,
+			header:     "Authorization",
+			value:      "token " + token,
+		}
+	case gitlabURLTemplates:
+		token = c.opts.GitLabToken
+		// Like project paths, refs must be escaped whole, slashes and all.
+		api = apiInfo{
+			url:        fmt.Sprintf("%s://%s/api/v4/projects/%s", u.Scheme, u.Host, url.PathEscape(project)),
+			commitPath: "/repository/commits/",
+			escapeRef:  url.PathEscape,
+			header:     "PRIVATE-TOKEN",
+			value:      token,
+		}
+	default:
+		return nil, fmt.Errorf("no API for %q", info.repoURL)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("no token for %q", info.repoURL)
+	}
+	return &api, nil
+}
+
+// guessDefaultBranch returns the first of "main" and "master" that the
+// repo's host serves a directory page for.
+func (c *Client) guessDefaultBranch(ctx context.Context, info *Info) (string, error) {
+	for _, branch := range []string{"main", "master"} {
+		i := *info
+		i.moduleDir = ""
+		i.commit = branch
+		i.refKind = branchRef
+		u := i.ModuleURL()
+		if u == "" {
+			break
+		}
+		res, err := c.doURL(ctx, "HEAD", u, true)
+		if err == nil {
+			res.Body.Close()
+			return branch, nil
+		}
+	}
+	return "", fmt.Errorf("could not determine default branch of %q: %w", info.repoURL, derrors.NotFound)
+}
+
+// getJSON makes a GET request to url with the given header set to value,
+// and decodes the JSON response into v.
+func (c *Client) getJSON(ctx context.Context, url, header, value string, v interface{}) (err error) {
+	defer derrors.Wrap(&err, "getJSON(ctx, %q)", url)
+
+	if c == nil || c.httpClient == nil {
+		return fmt.Errorf("c.httpClient cannot be nil")
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(header, value)
+	resp, err := c.do(ctx, req, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,288 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/pkgsite/internal/derrors"
+)
+
+// newAPITestServer returns a server that acts like the GitHub and GitLab APIs
+// for repo a/b, whose default branch is "trunk". It also serves directory pages
+// for the "master" branches of a/b and c/d, the latter of which is unknown to
+// the API. It requires the given tokens, and
+// counts the requests it receives.
+func newAPITestServer(githubToken, gitlabToken string, nRequests *int) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/a/b", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token "+githubToken {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"default_branch": "trunk"}`)
+	})
+	mux.HandleFunc("/api/v4/projects/a/b", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != gitlabToken {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"default_branch": "trunk"}`)
+	})
+	mux.HandleFunc("/a/b/tree/master", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/c/d/tree/master", func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*nRequests++
+		mux.ServeHTTP(w, r)
+	}))
+	return srv
+}
+
+func TestDefaultBranch(t *testing.T) {
+	ctx := context.Background()
+	var n int
+	srv := newAPITestServer("ghtoken", "gltoken", &n)
+	defer srv.Close()
+
+	for _, test := range []struct {
+		desc      string
+		opts      Options
+		repo      string
+		templates urlTemplates
+		want      string
+	}{
+		{"github API", Options{GitHubToken: "ghtoken"}, "a/b", githubURLTemplates, "trunk"},
+		{"gitlab API", Options{GitLabToken: "gltoken"}, "a/b", gitlabURLTemplates, "trunk"},
+		{"no token", Options{}, "c/d", githubURLTemplates, "master"},
+		{"bad token", Options{GitHubToken: "bad"}, "a/b", githubURLTemplates, "master"},
+		{"API fails", Options{GitHubToken: "ghtoken"}, "c/d", githubURLTemplates, "master"},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			c := NewClientWithOptions(testTimeout, test.opts)
+			c.githubAPIURL = srv.URL
+			info := &Info{repoURL: srv.URL + "/" + test.repo, templates: test.templates}
+			got, err := c.DefaultBranch(ctx, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			// The second call should be served from the cache.
+			n = 0
+			got, err = c.DefaultBranch(ctx, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want || n != 0 {
+				t.Errorf("second call: got %q with %d requests, want %q with none", got, n, test.want)
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		c := NewClient(testTimeout)
+		info := &Info{repoURL: srv.URL + "/x/y", templates: githubURLTemplates}
+		if got, err := c.DefaultBranch(ctx, info); err == nil {
+			t.Errorf("got %q, want error", got)
+		}
+	})
+}
+
+// fakeResolver is a CommitResolver that resolves refs from maps.
+type fakeResolver struct {
+	tags     map[string]string // from tag to commit
+	branches map[string]string // from repo URL to default branch
+}
+
+func (r fakeResolver) ResolveTag(ctx context.Context, info *Info, tag string) (string, error) {
+	if c, ok := r.tags[tag]; ok {
+		return c, nil
+	}
+	return "", derrors.NotFound
+}
+
+func (r fakeResolver) DefaultBranch(ctx context.Context, info *Info) (string, error) {
+	if b, ok := r.branches[info.RepoURL()]; ok {
+		return b, nil
+	}
+	return "", derrors.NotFound
+}
+
+func TestCommitResolver(t *testing.T) {
+	ctx := context.Background()
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	c := NewClientWithOptions(testTimeout, Options{
+		PreferCommitHash: true,
+		CommitResolver: fakeResolver{
+			tags:     map[string]string{"v1.0.0": sha},
+			branches: map[string]string{"https://github.com/a/b": "trunk"},
+		},
+	})
+	c.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected request for %s", r.URL)
+		return nil, errors.New("no requests")
+	})
+
+	info, err := ModuleInfo(ctx, c, "github.com/a/b", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.FileURL("f.go"), "https://github.com/a/b/blob/"+sha+"/f.go"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// A tag that the resolver doesn't know is used as is.
+	info, err = ModuleInfo(ctx, c, "github.com/a/b", "v1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.FileURL("f.go"), "https://github.com/a/b/blob/v1.1.0/f.go"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	got, err := c.DefaultBranch(ctx, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "trunk" {
+		t.Errorf("DefaultBranch: got %q, want %q", got, "trunk")
+	}
+}
+
+func TestPreferCommitHash(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	var nRequests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nRequests++
+		// The slash of the nested module's tag is not escaped.
+		if r.URL.EscapedPath() == "/repos/a/b/commits/sub/v1.2.3" && r.Header.Get("Authorization") == "token ghtoken" {
+			fmt.Fprintf(w, `{"sha": %q}`, sha)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	for _, test := range []struct {
+		desc       string
+		opts       Options
+		modulePath string
+		version    string
+		want       string
+		wantAPI    bool
+	}{
+		{"resolved", Options{GitHubToken: "ghtoken", PreferCommitHash: true}, "github.com/a/b/sub", "v1.2.3", sha, true},
+		{"unknown tag", Options{GitHubToken: "ghtoken", PreferCommitHash: true}, "github.com/a/b/sub", "v1.2.4", "sub/v1.2.4", true},
+		{"no token", Options{PreferCommitHash: true}, "github.com/a/b/sub", "v1.2.3", "sub/v1.2.3", false},
+		{"not preferred", Options{GitHubToken: "ghtoken"}, "github.com/a/b/sub", "v1.2.3", "sub/v1.2.3", false},
+		{"pseudo-version", Options{GitHubToken: "ghtoken", PreferCommitHash: true}, "github.com/a/b/sub", "v0.0.0-20200101000000-abcdef123456", "abcdef123456", false},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			c := NewClientWithOptions(testTimeout, test.opts)
+			c.githubAPIURL = srv.URL
+			nRequests = 0
+			info, err := ModuleInfo(context.Background(), c, test.modulePath, test.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.commit != test.want {
+				t.Errorf("got commit %q, want %q", info.commit, test.want)
+			}
+			if gotAPI := nRequests > 0; gotAPI != test.wantAPI {
+				t.Errorf("called API: got %t, want %t", gotAPI, test.wantAPI)
+			}
+		})
+	}
+}
+
+func TestRequestsUseHTTPClient(t *testing.T) {
+	// Route all requests through a proxy that records them. It refuses to
+	// tunnel HTTPS requests, and serves HTTP requests from testWeb.
+	var got []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			got = append(got, r.Method+" "+r.Host)
+			http.Error(w, "no tunneling", http.StatusForbidden)
+			return
+		}
+		r.URL.RawQuery = ""
+		got = append(got, r.Method+" "+r.URL.String())
+		body, ok := testWeb[r.URL.String()]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClientWithHTTPClient(&http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   testTimeout,
+	}, Options{})
+
+	ctx := context.Background()
+	// Meta tags are fetched over HTTP after HTTPS fails.
+	if _, err := ModuleInfo(ctx, c, "alice.org/pkg/http", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	// The go.mod file of a possibly versioned directory is checked.
+	info, err := ModuleInfo(ctx, c, "github.com/a/b/v2", "v2.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Default branches are guessed without a token.
+	if _, err := c.DefaultBranch(ctx, info); err == nil {
+		t.Error("DefaultBranch succeeded, want error")
+	}
+
+	// The failure to connect is not retried with a trailing slash.
+	want := []string{
+		"CONNECT alice.org:443",
+		"GET http://alice.org/pkg/http",
+		"CONNECT github.com:443",
+		"CONNECT github.com:443",
+		"CONNECT github.com:443",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("requests mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestBranchURL(t *testing.T) {
+	ctx := context.Background()
+	var n int
+	srv := newAPITestServer("ghtoken", "", &n)
+	defer srv.Close()
+	c := NewClientWithOptions(testTimeout, Options{GitHubToken: "ghtoken"})
+	c.githubAPIURL = srv.URL
+
+	for _, version := range []string{
+		"v0.0.0-20200101000000-abcdef123456",
+		"v1.2.4-0.20200101000000-abcdef123456",
+		"v1.2.3-pre.0.20200101000000-abcdef123456",
+	} {
+		info, err := ModuleInfo(ctx, c, "github.com/a/b/sub", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.BranchURL(ctx, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "https://github.com/a/b/tree/trunk/sub"; got != want {
+			t.Errorf("%s: got %q, want %q", version, got, want)
+		}
+	}
+}
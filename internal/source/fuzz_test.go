@@ -0,0 +1,82 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package source
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzMatchStatic(f *testing.F) {
+	for _, s := range []string{
+		"github.com/a/b",
+		"github.com/a/b/c/d",
+		"github.com/a",
+		"gitlab.x.com/a/b.git",
+		"foo.googlesource.com/a/b/c.git/d",
+		"git.apache.org/thrift.git",
+		"git.com/repo.git/dir",
+		"x/a.b/c.git/d",
+		".git",
+		"a..git",
+		"a.b:/.git",
+		"a.b:99999999999999999999/c.svn",
+		"github.com/a/b\x00",
+		"github.com/a/b/\xff",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		repo, rel, _, err := matchStatic(in)
+		if err != nil {
+			return
+		}
+		if repo == "" {
+			t.Errorf("%q: matched with empty repo", in)
+		}
+		if !strings.HasSuffix(in, rel) {
+			t.Fatalf("%q: relative module path %q is not a suffix", in, rel)
+		}
+		// The relative module path follows the repo path and a slash.
+		if rel != "" && !strings.HasSuffix(in[:len(in)-len(rel)], "/") {
+			t.Errorf("%q: relative module path %q does not follow a slash", in, rel)
+		}
+		_ = removeVersionSuffix(rel)
+	})
+}
+
+func FuzzCommitFromVersion(f *testing.F) {
+	for _, s := range []string{
+		"v1.2.3",
+		"v1.2.3+incompatible",
+		"v0.0.0-20190311183353-d8887717615a",
+		"v2.0.0-20200101000000-abcdef123456+incompatible",
+		"v1.2.4-0.20190311183353-d8887717615a",
+		"v1.2.3-pre.0.20190311183353-d8887717615a",
+		"-",
+		"v",
+		"+incompatible",
+		"master",
+		"",
+	} {
+		f.Add(s, "")
+		f.Add(s, "sub/v2")
+	}
+	f.Fuzz(func(t *testing.T, version, dir string) {
+		commit := commitFromVersion(version, dir)
+		if commit == "" || strings.Contains(version, commit) {
+			return
+		}
+		// Otherwise the commit is a tag of a nested module: the tag's
+		// directory, then the version.
+		i := strings.LastIndex(commit, "/")
+		if i < 0 || commit[:i] != removeVersionSuffix(dir) || !strings.Contains(version, commit[i+1:]) {
+			t.Errorf("commitFromVersion(%q, %q) = %q, which is not from the version", version, dir, commit)
+		}
+	})
+}
@@ -7,8 +7,11 @@ package source
 import (
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"regexp"
 	"strings"
 
 	"golang.org/x/pkgsite/internal/derrors"
@@ -16,19 +19,21 @@ import (
 
 // This code adapted from https://go.googlesource.com/gddo/+/refs/heads/master/gosrc/gosrc.go.
 
-// sourceMeta represents the values in a go-source meta tag, or as a fallback,
+// SourceMeta represents the values in a go-source meta tag, or as a fallback,
 // values from a go-import meta tag.
 // The go-source spec is at https://github.com/golang/gddo/wiki/Source-Code-Links.
 // The go-import spec is in "go help importpath".
-type sourceMeta struct {
-	repoRootPrefix string // import path prefix corresponding to repo root
-	repoURL        string // URL of the repo root
-	// The next two are only present in a go-source tag.
-	dirTemplate  string // URL template for a directory
-	fileTemplate string // URL template for a file and line
+type SourceMeta struct {
+	RepoRootPrefix string // import path prefix corresponding to repo root
+	RepoURL        string // URL of the repo root
+	VCS            string // version control system, from the go-import tag
+	// The next three are only present in a go-source tag.
+	Home         string // home page of the repo; empty if "_"
+	DirTemplate  string // URL template for a directory
+	FileTemplate string // URL template for a file and line
 }
 
-// fetchMeta retrieves go-import and go-source meta tag information, using the import path to construct
+// FetchMeta retrieves go-import and go-source meta tag information, using the import path to construct
 // a URL as described in "go help importpath".
 //
 // The importPath argument, as the name suggests, could be any package import
@@ -37,8 +42,11 @@ type sourceMeta struct {
 // The discovery site only cares about linking to source, not fetching it (we
 // already have it in the module zip file). So we merge the go-import and
 // go-source meta tag information, preferring the latter.
-func fetchMeta(ctx context.Context, client *Client, importPath string) (_ *sourceMeta, err error) {
-	defer derrors.Wrap(&err, "fetchMeta(ctx, client, %q)", importPath)
+//
+// FetchMeta uses https, and falls back to http if that fails, unless the
+// request budget is exhausted or the host is rate limiting requests.
+func FetchMeta(ctx context.Context, client *Client, importPath string) (_ *SourceMeta, err error) {
+	defer derrors.Wrap(&err, "FetchMeta(ctx, client, %q)", importPath)
 
 	uri := importPath
 	if !strings.Contains(uri, "/") {
@@ -47,18 +55,44 @@ func fetchMeta(ctx context.Context, client *Client, importPath string) (_ *sourc
 	}
 	uri = uri + "?go-get=1"
 
-	resp, err := client.doURL(ctx, "GET", "https://"+uri, true)
+	u := "https://" + uri
+	resp, err := client.doURL(ctx, "GET", u, false)
+	if err == nil && resp.StatusCode != http.StatusOK && !strings.HasSuffix(importPath, "/") && strings.Contains(importPath, "/") {
+		// Some servers only serve the meta tags at a URL with a trailing
+		// slash, without redirecting to it. (Redirects are followed by the
+		// HTTP client.) Other failures, like those of the network, would
+		// likely recur.
+		resp.Body.Close()
+		u = "https://" + importPath + "/?go-get=1"
+		resp, err = client.doURL(ctx, "GET", u, false)
+	}
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("GET %s: status %s", u, resp.Status)
+	}
 	if err != nil {
+		if errors.Is(err, ErrRequestBudgetExceeded) || errors.Is(err, ErrRateLimited) {
+			return nil, err
+		}
+		// The http fallback is tried only without a trailing slash, and
+		// its response is parsed whatever its status: some hosts serve
+		// their meta tags on error pages, reached by redirects from http.
+		httpsErr := err
 		resp, err = client.doURL(ctx, "GET", "http://"+uri, false)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%v; then %w", httpsErr, err)
 		}
 	}
 	defer resp.Body.Close()
-	return parseMeta(importPath, resp.Body)
+	sm, err := parseMeta(importPath, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	traceFrom(ctx).add("meta", "repo root %q, repo URL %q", sm.RepoRootPrefix, sm.RepoURL)
+	return sm, nil
 }
 
-func parseMeta(importPath string, r io.Reader) (sm *sourceMeta, err error) {
+func parseMeta(importPath string, r io.Reader) (sm *SourceMeta, err error) {
 	errorMessage := "go-import and go-source meta tags not found"
 	// gddo uses an xml parser, and this code is adapted from it.
 	d := xml.NewDecoder(r)
@@ -81,7 +115,9 @@ metaScan:
 			if !strings.EqualFold(t.Name.Local, "meta") {
 				continue metaScan
 			}
-			nameAttr := attrValue(t.Attr, "name")
+			// The XML decoder handles either kind of quote, and whitespace
+			// between attributes. Be lenient about the name's spacing and case too.
+			nameAttr := strings.ToLower(strings.TrimSpace(attrValue(t.Attr, "name")))
 			if nameAttr != "go-import" && nameAttr != "go-source" {
 				continue metaScan
 			}
@@ -111,9 +147,10 @@ metaScan:
 					errorMessage = "more than one go-import meta tag found"
 					break metaScan
 				}
-				sm = &sourceMeta{
-					repoRootPrefix: repoRootPrefix,
-					repoURL:        fields[2],
+				sm = &SourceMeta{
+					RepoRootPrefix: repoRootPrefix,
+					RepoURL:        fields[2],
+					VCS:            fields[1],
 				}
 				// Keep going in the hope of finding a go-source tag.
 			case "go-source":
@@ -121,25 +158,33 @@ metaScan:
 					errorMessage = "go-source meta tag content attribute does not have four fields"
 					continue metaScan
 				}
-				if sm != nil && sm.repoRootPrefix != repoRootPrefix {
-					errorMessage = fmt.Sprintf("import path prefixes %q for go-import and %q for go-source disagree", sm.repoRootPrefix, repoRootPrefix)
+				if sm != nil && sm.RepoRootPrefix != repoRootPrefix {
+					errorMessage = fmt.Sprintf("import path prefixes %q for go-import and %q for go-source disagree", sm.RepoRootPrefix, repoRootPrefix)
 					sm = nil
 					break metaScan
 				}
 				// If go-source repo is "_", then default to the go-import repo.
-				repoURL := fields[1]
-				if repoURL == "_" {
+				home := fields[1]
+				repoURL := home
+				if home == "_" {
 					if sm == nil {
 						errorMessage = `go-source repo is "_", but no previous go-import tag`
 						break metaScan
 					}
-					repoURL = sm.repoURL
+					home = ""
+					repoURL = sm.RepoURL
 				}
-				sm = &sourceMeta{
-					repoRootPrefix: repoRootPrefix,
-					repoURL:        repoURL,
-					dirTemplate:    fields[2],
-					fileTemplate:   fields[3],
+				var vcs string
+				if sm != nil {
+					vcs = sm.VCS
+				}
+				sm = &SourceMeta{
+					RepoRootPrefix: repoRootPrefix,
+					RepoURL:        repoURL,
+					VCS:            vcs,
+					Home:           home,
+					DirTemplate:    fields[2],
+					FileTemplate:   fields[3],
 				}
 				break metaScan
 			}
@@ -159,3 +204,100 @@ func attrValue(attrs []xml.Attr, name string) string {
 	}
 	return ""
 }
+
+// absoluteTemplate returns the go-source URL template templ as an absolute
+// URL. Most go-source templates are absolute, but some omit the repo URL,
+// like "{/dir}" or "/tree/master{/dir}"; for those, absoluteTemplate prepends
+// repoURL.
+func absoluteTemplate(repoURL, templ string) string {
+	if templ == "" || templ == noTemplate || strings.HasPrefix(templ, "http://") || strings.HasPrefix(templ, "https://") {
+		return templ
+	}
+	repoURL = strings.TrimSuffix(repoURL, "/")
+	if strings.HasPrefix(templ, "/") || strings.HasPrefix(templ, "{/") {
+		return repoURL + templ
+	}
+	return repoURL + "/" + templ
+}
+
+// noTemplate is the go-source URL template that says there is none. It is
+// kept as is, so that a template that is absent can be told apart from one
+// that was not given, and URLs built from it are empty.
+const noTemplate = "_"
+
+// legacyTemplate rewrites the placeholders of old go-source URL templates to
+// their current forms. Templates that predate "{/dir}" use "/{dir}", which
+// leaves a trailing slash for the repo's root directory.
+func legacyTemplate(templ string) string {
+	if templ == noTemplate {
+		return noTemplate
+	}
+	return strings.Replace(templ, "/{dir}", "{/dir}", -1)
+}
+
+// hgwebRawTemplate is the template for raw files of Mercurial repos served by
+// hgweb.
+const hgwebRawTemplate = "{repo}/raw-file/{commit}/{file}"
+
+// hgwebDirRegexp matches a go-source directory template for a Mercurial repo
+// served by hgweb. The groups are the repo URL and the revision, which is
+// typically "tip", "default" or "@".
+var hgwebDirRegexp = regexp.MustCompile(`^(https?://[^{]+?)/file/([^/{]+)\{/dir\}$`)
+
+// hgwebTemplates tries to construct URL templates for a Mercurial repo served
+// by hgweb from the templates of a go-source meta tag. Those templates name a
+// fixed revision, which we replace with {commit}. It returns the repo URL and
+// the templates, and reports whether the go-source templates were recognized.
+func hgwebTemplates(sm *SourceMeta) (repoURL string, _ urlTemplates, ok bool) {
+	if sm.VCS != "" && sm.VCS != "hg" {
+		return "", urlTemplates{}, false
+	}
+	m := hgwebDirRegexp.FindStringSubmatch(sm.DirTemplate)
+	if m == nil {
+		return "", urlTemplates{}, false
+	}
+	// The file template should be the directory template followed by the
+	// file, and optionally a line anchor, like "#l{line}".
+	filePrefix := sm.DirTemplate + "/{file}"
+	if !strings.HasPrefix(sm.FileTemplate, filePrefix) {
+		return "", urlTemplates{}, false
+	}
+	anchor := strings.TrimPrefix(sm.FileTemplate, filePrefix)
+	if !strings.HasPrefix(anchor, "#") || !strings.Contains(anchor, "{line}") {
+		anchor = "#l{line}"
+	}
+	return m[1], urlTemplates{
+		Directory: "{repo}/file/{commit}/{dir}",
+		File:      "{repo}/file/{commit}/{file}",
+		Line:      "{repo}/file/{commit}/{file}" + anchor,
+		Raw:       hgwebRawTemplate,
+	}, true
+}
+
+// gitServerDirPatterns match the go-source directory templates of git repos
+// served by web front ends that we know, which name a fixed ref. The group is
+// the repo URL.
+var gitServerDirPatterns = []struct {
+	re        *regexp.Regexp
+	templates urlTemplates
+}{
+	// Gitiles, like "https://example.com/repo/+/master{/dir}".
+	{regexp.MustCompile(`^(https?://[^{]+?)/\+/[^/{]+\{/dir\}$`), gitilesURLTemplates},
+	// cgit, like "https://example.com/repo/tree{/dir}?h=master".
+	{regexp.MustCompile(`^(https?://[^{?]+?)/tree\{/dir\}\?h=[^&{]+$`), cgitURLTemplates},
+}
+
+// gitServerTemplates is like hgwebTemplates, for git repos served by the
+// front ends of gitServerDirPatterns on hosts that we don't otherwise know,
+// like personal vanity hosts.
+func gitServerTemplates(sm *SourceMeta) (repoURL string, _ urlTemplates, ok bool) {
+	if sm.VCS != "" && sm.VCS != "git" {
+		return "", urlTemplates{}, false
+	}
+	for _, p := range gitServerDirPatterns {
+		if m := p.re.FindStringSubmatch(sm.DirTemplate); m != nil {
+			return m[1], p.templates, true
+		}
+	}
+	return "", urlTemplates{}, false
+}
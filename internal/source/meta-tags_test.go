@@ -0,0 +1,230 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/pkgsite/internal/derrors"
+)
+
+func TestFetchMeta(t *testing.T) {
+	client := &Client{
+		httpClient: &http.Client{
+			Transport: testTransport(testWeb),
+			Timeout:   testTimeout,
+		},
+	}
+	for _, test := range []struct {
+		importPath string
+		want       *SourceMeta // if nil, then want NotFound
+	}{
+		{
+			"alice.org/pkg",
+			&SourceMeta{
+				RepoRootPrefix: "alice.org/pkg",
+				RepoURL:        "https://github.com/alice/pkg",
+				VCS:            "git",
+			},
+		},
+		{
+			"alice.org/pkg/source",
+			&SourceMeta{
+				RepoRootPrefix: "alice.org/pkg",
+				RepoURL:        "http://alice.org/pkg",
+				VCS:            "git",
+				Home:           "http://alice.org/pkg",
+				DirTemplate:    "http://alice.org/pkg{/dir}",
+				FileTemplate:   "http://alice.org/pkg{/dir}?f={file}#Line{line}",
+			},
+		},
+		{
+			"alice.org/pkg/default",
+			&SourceMeta{
+				RepoRootPrefix: "alice.org/pkg",
+				RepoURL:        "https://github.com/alice/pkg",
+				VCS:            "git",
+				DirTemplate:    "foo",
+				FileTemplate:   "bar",
+			},
+		},
+		{
+			"dave.org/pkg",
+			// Only served with a trailing slash.
+			&SourceMeta{
+				RepoRootPrefix: "dave.org/pkg",
+				RepoURL:        "https://github.com/dave/pkg",
+				VCS:            "git",
+			},
+		},
+		{"alice.org/pkg/multiple", nil},
+		{"alice.org/pkg/notfound", nil},
+	} {
+		t.Run(test.importPath, func(t *testing.T) {
+			got, err := FetchMeta(context.Background(), client, test.importPath)
+			if test.want == nil {
+				if !errors.Is(err, derrors.NotFound) {
+					t.Fatalf("got error %v, want NotFound", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFetchMetaRedirect(t *testing.T) {
+	var importPath string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pkg" {
+			http.Redirect(w, r, "/pkg/", http.StatusMovedPermanently)
+			return
+		}
+		if r.URL.Path != "/pkg/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `<head><meta name="go-import" content="%s git https://github.com/dave/pkg"></head>`, importPath)
+	}))
+	defer srv.Close()
+	importPath = strings.TrimPrefix(srv.URL, "https://") + "/pkg"
+
+	got, err := FetchMeta(context.Background(), &Client{httpClient: srv.Client()}, importPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &SourceMeta{
+		RepoRootPrefix: importPath,
+		RepoURL:        "https://github.com/dave/pkg",
+		VCS:            "git",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestFetchMetaRetries(t *testing.T) {
+	for _, test := range []struct {
+		desc      string
+		roundTrip func(*http.Request) (*http.Response, error)
+		wantErr   error
+	}{
+		{
+			"network",
+			func(*http.Request) (*http.Response, error) { return nil, errors.New("no route to host") },
+			nil,
+		},
+		{
+			"rate limited",
+			func(*http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusTooManyRequests,
+					Header:     http.Header{"Retry-After": []string{"60"}},
+					Body:       http.NoBody,
+				}, nil
+			},
+			ErrRateLimited,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var nRequests int
+			client := NewClient(testTimeout)
+			client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				nRequests++
+				return test.roundTrip(r)
+			})
+			_, err := FetchMeta(context.Background(), client, "example.com/pkg/sub")
+			if err == nil {
+				t.Fatal("got nil error")
+			}
+			if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Errorf("got error %v, want %v", err, test.wantErr)
+			}
+			// The network failure is not retried with a trailing slash, but it
+			// is retried over http.
+			want := 2
+			if test.wantErr != nil {
+				want = 1
+			}
+			if nRequests != want {
+				t.Errorf("got %d requests, want %d", nRequests, want)
+			}
+		})
+	}
+
+	// A budget exceeded by the first request is not retried.
+	var nRequests int
+	client := NewClientWithOptions(testTimeout, Options{MaxRequests: 1})
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		nRequests++
+		return testTransport(nil).RoundTrip(r)
+	})
+	if _, err := ModuleInfo(context.Background(), client, "example.com/pkg/sub", "v1.0.0"); !errors.Is(err, ErrRequestBudgetExceeded) {
+		t.Errorf("got error %v, want ErrRequestBudgetExceeded", err)
+	}
+	if nRequests != 1 {
+		t.Errorf("got %d requests, want 1", nRequests)
+	}
+
+	// The error of a retry with a trailing slash names the URL retried.
+	errHTTP := errors.New("connection refused")
+	client = NewClient(testTimeout)
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Scheme == "http" {
+			return nil, errHTTP
+		}
+		return testTransport(nil).RoundTrip(r)
+	})
+	_, err := FetchMeta(context.Background(), client, "example.com/pkg/sub")
+	if !errors.Is(err, errHTTP) {
+		t.Errorf("got error %v, want %v", err, errHTTP)
+	}
+	if want := "GET https://example.com/pkg/sub/?go-get=1: status"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want one containing %q", err, want)
+	}
+}
+
+func TestParseMetaMessy(t *testing.T) {
+	want := &SourceMeta{
+		RepoRootPrefix: "example.com/pkg",
+		RepoURL:        "https://github.com/example/pkg",
+		VCS:            "git",
+	}
+	for _, test := range []struct {
+		desc, html string
+	}{
+		{"single quotes", `<meta name='go-import' content='example.com/pkg git https://github.com/example/pkg'>`},
+		{"mixed quotes", `<meta name="go-import" content='example.com/pkg git https://github.com/example/pkg'>`},
+		{"spaces in content", `<meta name="go-import" content="  example.com/pkg   git https://github.com/example/pkg  ">`},
+		{"tabs and newlines", "<meta name=\"go-import\" content=\"example.com/pkg\tgit\n\t\thttps://github.com/example/pkg\">"},
+		{"spaces in name", `<meta name=" go-import " content="example.com/pkg git https://github.com/example/pkg">`},
+		{"upper-case name", `<meta name="Go-Import" content="example.com/pkg git https://github.com/example/pkg">`},
+		{"spaces around equals", `<meta name = "go-import" content = "example.com/pkg git https://github.com/example/pkg" >`},
+		{"unquoted name", `<meta name=go-import content="example.com/pkg git https://github.com/example/pkg">`},
+		{"self-closing", `<META NAME="go-import" CONTENT="example.com/pkg git https://github.com/example/pkg"/>`},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := parseMeta("example.com/pkg", strings.NewReader("<html><head>"+test.html+"</head></html>"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/pkgsite/internal/derrors"
+)
+
+// An Origin describes where a module version came from, as reported in the
+// Origin field of the .info file served by module proxies that support it.
+type Origin struct {
+	VCS    string // version control system, like "git"
+	URL    string // URL of the repo
+	Subdir string // directory of the module in the repo
+	Hash   string // commit hash
+	Ref    string // ref resolved to Hash, like "refs/tags/v1.2.3"
+	// HEAD is the ref that the repo's HEAD points to, like "refs/heads/main",
+	// if the proxy reports it.
+	HEAD string
+}
+
+// InfoFromOrigin returns an Info for a module from the Origin of one of its
+// versions, without matching patterns or fetching meta tags. URLs use the
+// origin's commit hash, or if it has none, the name of its ref.
+func InfoFromOrigin(origin *Origin) (_ *Info, err error) {
+	defer derrors.Wrap(&err, "InfoFromOrigin(%+v)", origin)
+
+	if origin == nil || origin.URL == "" {
+		return nil, fmt.Errorf("no repo URL: %w", derrors.InvalidArgument)
+	}
+	repoURL := strings.TrimSuffix(strings.TrimSuffix(origin.URL, "/"), ".git")
+	repo, _, templates, err := matchStatic(removeHTTPScheme(repoURL))
+	if err == nil {
+		repoURL = "https://" + repo
+	} else if repo, templates = matchCloneURL(repoURL); templates != (urlTemplates{}) {
+		repoURL = "https://" + repo
+	}
+	commit, kind := origin.Hash, commitRef
+	if commit == "" {
+		commit, kind = refName(origin.Ref)
+	}
+	if commit == "" {
+		return nil, fmt.Errorf("no hash or ref: %w", derrors.InvalidArgument)
+	}
+	info := &Info{
+		repoURL:   repoURL,
+		moduleDir: strings.Trim(origin.Subdir, "/"),
+		commit:    commit,
+		refKind:   kind,
+		templates: templates,
+	}
+	info.forgetGuessableRefKind()
+	return info, nil
+}
+
+// refName returns the short name of a git ref, like "v1.2.3" for
+// "refs/tags/v1.2.3" and "main" for "refs/heads/main", and the kind of ref it
+// is.
+func refName(ref string) (string, refKind) {
+	if strings.HasPrefix(ref, "refs/tags/") {
+		return strings.TrimPrefix(ref, "refs/tags/"), tagRef
+	}
+	if strings.HasPrefix(ref, "refs/heads/") {
+		return strings.TrimPrefix(ref, "refs/heads/"), branchRef
+	}
+	return ref, unknownRef
+}
+
+// ResolveOrigin is like InfoFromOrigin, but if origin records the branch that
+// the repo's HEAD points to, like "refs/heads/main", it also records that
+// branch as the default branch of the repo, so that DefaultBranch and
+// BranchURL need not make any requests for it. The branch of origin's Ref is
+// not taken to be the default, since a query may have named any branch. URLs
+// from the returned Info use the origin's commit hash.
+func (c *Client) ResolveOrigin(origin *Origin) (*Info, error) {
+	info, err := InfoFromOrigin(origin)
+	if err != nil {
+		return nil, err
+	}
+	if branch := strings.TrimPrefix(origin.HEAD, "refs/heads/"); branch != origin.HEAD && branch != "" {
+		st := c.state()
+		st.mu.Lock()
+		if st.branchesByURL == nil {
+			st.branchesByURL = map[string]string{}
+		}
+		st.branchesByURL[info.repoURL] = branch
+		st.mu.Unlock()
+	}
+	return info, nil
+}
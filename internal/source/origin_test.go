@@ -0,0 +1,104 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/pkgsite/internal/derrors"
+)
+
+func TestInfoFromOrigin(t *testing.T) {
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	for _, test := range []struct {
+		desc   string
+		origin *Origin
+		want   *Info
+	}{
+		{
+			"tag and hash",
+			&Origin{VCS: "git", URL: "https://github.com/a/b", Subdir: "sub", Hash: hash, Ref: "refs/tags/sub/v1.2.3"},
+			&Info{repoURL: "https://github.com/a/b", moduleDir: "sub", commit: hash, templates: githubURLTemplates},
+		},
+		{
+			"tag only",
+			&Origin{VCS: "git", URL: "https://gitlab.com/a/b.git", Ref: "refs/tags/v1.2.3"},
+			&Info{repoURL: "https://gitlab.com/a/b", commit: "v1.2.3", templates: gitlabURLTemplates},
+		},
+		{
+			"unknown host",
+			&Origin{VCS: "git", URL: "https://git.example.com/r", Hash: hash},
+			&Info{repoURL: "https://git.example.com/r", commit: hash},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := InfoFromOrigin(test.origin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.want, got, cmp.AllowUnexported(Info{}, urlTemplates{})); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	for _, o := range []*Origin{nil, {VCS: "git"}, {VCS: "git", URL: "https://github.com/a/b"}} {
+		if _, err := InfoFromOrigin(o); !errors.Is(err, derrors.InvalidArgument) {
+			t.Errorf("%+v: got error %v, want InvalidArgument", o, err)
+		}
+	}
+}
+
+func TestResolveOrigin(t *testing.T) {
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	var nRequests int
+	client := NewClient(testTimeout)
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		nRequests++
+		return nil, errors.New("no requests expected")
+	})
+	// The repo has branches "main", the default, and "trunk".
+	info, err := client.ResolveOrigin(&Origin{VCS: "git", URL: "https://github.com/a/b", Hash: hash, Ref: "refs/heads/trunk", HEAD: "refs/heads/main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.FileURL("f.go"), "https://github.com/a/b/blob/"+hash+"/f.go"; got != want {
+		t.Errorf("FileURL: got %q, want %q", got, want)
+	}
+	got, err := client.BranchURL(context.Background(), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://github.com/a/b/tree/main"; got != want {
+		t.Errorf("BranchURL: got %q, want %q", got, want)
+	}
+	if nRequests != 0 {
+		t.Errorf("got %d requests, want 0", nRequests)
+	}
+}
+
+func TestResolveOriginBranchNotDefault(t *testing.T) {
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	client := NewClient(testTimeout)
+	client.httpClient.Transport = testTransport(map[string]string{
+		"https://github.com/a/c/tree/main": "",
+	})
+	// Without HEAD, the branch of the ref is not known to be the default.
+	info, err := client.ResolveOrigin(&Origin{VCS: "git", URL: "https://github.com/a/c", Hash: hash, Ref: "refs/heads/trunk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.BranchURL(context.Background(), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://github.com/a/c/tree/main"; got != want {
+		t.Errorf("BranchURL: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"fmt"
+	"regexp"
+
+	"golang.org/x/pkgsite/internal/derrors"
+)
+
+// A ProviderConfig describes how to build URLs for the repos of a hosting
+// site, so that sites can be supported without changes to this package.
+//
+// The template fields correspond to the methods of Info. Each may use the
+// variable {repo}, the variables {owner} and {name} if Pattern has groups for
+// them, and those listed for it below, and must use all of the latter except
+// {repoPath}. An empty template means the site has no such URLs.
+type ProviderConfig struct {
+	// Pattern matches module paths and repo URLs without a scheme, like
+	// "git.example.com/owner/repo". It must have a group named "repo" for the
+	// repo, and may have groups named "owner" and "name". It must begin with
+	// "^", so that it matches only at the start of the path.
+	Pattern string
+
+	Directory    string // {commit} and {dir}
+	File         string // {commit} and {file}
+	Line         string // {commit}, {file} and {line}
+	LineRange    string // {commit}, {file}, {start} and {end}
+	Raw          string // {repoPath}, {commit} and {file}
+	RawLineRange string // {repoPath}, {commit}, {file}, {start} and {end}
+	Issues       string // no others
+	Compare      string // {commit} and {otherCommit}
+	Release      string // {tag}
+	Wiki         string // no others
+}
+
+// RegisterProvider causes module paths and repo URLs that match cfg.Pattern to
+// use cfg's templates. Providers are tried in the order they are registered,
+// after the sites this package knows of. RegisterProvider returns an error
+// wrapping derrors.InvalidArgument if the pattern is invalid or a template
+// uses a variable it does not support or lacks one it needs.
+//
+// Like AddGiteaHost, RegisterProvider must be called before any source
+// information is resolved.
+//
+// To resolve the modules of a private host without making any requests, list
+// the host in Options.PrivateHosts too.
+func RegisterProvider(cfg ProviderConfig) (err error) {
+	defer derrors.Wrap(&err, "RegisterProvider(%q)", cfg.Pattern)
+
+	re, err := regexp.Compile(cfg.Pattern)
+	if err != nil {
+		return fmt.Errorf("%v: %w", err, derrors.InvalidArgument)
+	}
+	if !contains(re.SubexpNames(), "repo") {
+		return fmt.Errorf("pattern has no repo group: %w", derrors.InvalidArgument)
+	}
+	if !anchored(re) {
+		return fmt.Errorf("pattern does not begin with ^: %w", derrors.InvalidArgument)
+	}
+	templates := urlTemplates{
+		Directory:    cfg.Directory,
+		File:         cfg.File,
+		Line:         cfg.Line,
+		LineRange:    cfg.LineRange,
+		Raw:          cfg.Raw,
+		RawLineRange: cfg.RawLineRange,
+		Issues:       cfg.Issues,
+		Compare:      cfg.Compare,
+		Release:      cfg.Release,
+		Wiki:         cfg.Wiki,
+	}
+	optional := []string{"repo"}
+	for _, g := range []string{"owner", "name"} {
+		if contains(re.SubexpNames(), g) {
+			optional = append(optional, g)
+		}
+	}
+	for _, t := range []struct {
+		field, templ string
+		vars         []string
+	}{
+		{"Directory", cfg.Directory, []string{"commit", "dir"}},
+		{"File", cfg.File, []string{"commit", "file"}},
+		{"Line", cfg.Line, []string{"commit", "file", "line"}},
+		{"LineRange", cfg.LineRange, []string{"commit", "file", "start", "end"}},
+		{"Raw", cfg.Raw, []string{"repoPath", "commit", "file"}},
+		{"RawLineRange", cfg.RawLineRange, []string{"repoPath", "commit", "file", "start", "end"}},
+		{"Issues", cfg.Issues, nil},
+		{"Compare", cfg.Compare, []string{"commit", "otherCommit"}},
+		{"Release", cfg.Release, []string{"tag"}},
+		{"Wiki", cfg.Wiki, nil},
+	} {
+		if err := checkPlaceholders(t.templ, optional, t.vars); err != nil {
+			return fmt.Errorf("%s template: %v: %w", t.field, err, derrors.InvalidArgument)
+		}
+	}
+	addPattern(re, templates)
+	return nil
+}
+
+// placeholderRegexp matches a variable in a URL template, like "{repo}".
+var placeholderRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// checkPlaceholders returns an error if the non-empty template templ uses a
+// variable that is in neither optional nor vars, or does not use one of vars
+// other than "repoPath", without which URLs built from it would be incomplete.
+func checkPlaceholders(templ string, optional, vars []string) error {
+	if templ == "" {
+		return nil
+	}
+	var used []string
+	for _, m := range placeholderRegexp.FindAllStringSubmatch(templ, -1) {
+		if !contains(optional, m[1]) && !contains(vars, m[1]) {
+			return fmt.Errorf("unknown variable %q", m[0])
+		}
+		used = append(used, m[1])
+	}
+	for _, v := range vars {
+		if v != "repoPath" && !contains(used, v) {
+			return fmt.Errorf("missing variable %q", "{"+v+"}")
+		}
+	}
+	return nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"golang.org/x/pkgsite/internal/derrors"
+)
+
+// savePatterns restores the registered patterns when t and its subtests
+// finish, so that a test may register its own.
+func savePatterns(t *testing.T) {
+	p := patterns
+	t.Cleanup(func() { patterns = p })
+}
+
+func TestRegisterProvider(t *testing.T) {
+	savePatterns(t)
+
+	err := RegisterProvider(ProviderConfig{
+		Pattern:      `^(?P<repo>code\.example\.com/(?P<owner>[a-z]+)/(?P<name>[a-z]+))`,
+		Directory:    "{repo}/browse/{commit}/{dir}",
+		File:         "{repo}/browse/{commit}/{file}",
+		Line:         "{repo}/browse/{commit}/{file}?line={line}",
+		LineRange:    "{repo}/browse/{commit}/{file}?lines={start}-{end}",
+		Raw:          "https://raw.example.com/{repoPath}/{commit}/{file}",
+		RawLineRange: "https://raw.example.com/{repoPath}/{commit}/{file}#{start}-{end}",
+		Issues:       "https://bugs.example.com/{owner}/{name}",
+		Compare:      "{repo}/compare/{otherCommit}..{commit}",
+		Release:      "{repo}/releases/{tag}",
+		Wiki:         "https://wiki.example.com/{name}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ModuleInfo(context.Background(), nil, "code.example.com/a/b/sub", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const repo = "https://code.example.com/a/b"
+	for _, test := range []struct {
+		desc, got, want string
+	}{
+		{"RepoURL", info.RepoURL(), repo},
+		{"ModuleURL", info.ModuleURL(), repo + "/browse/sub/v1.0.0/sub"},
+		{"DirectoryURL", info.DirectoryURL("d"), repo + "/browse/sub/v1.0.0/sub/d"},
+		{"FileURL", info.FileURL("f.go"), repo + "/browse/sub/v1.0.0/sub/f.go"},
+		{"LineURL", info.LineURL("f.go", 3), repo + "/browse/sub/v1.0.0/sub/f.go?line=3"},
+		{"LineRangeURL", info.LineRangeURL("f.go", 3, 5), repo + "/browse/sub/v1.0.0/sub/f.go?lines=3-5"},
+		{"RawURL", info.RawURL("f.go"), "https://raw.example.com/a/b/sub/v1.0.0/sub/f.go"},
+		{"RawLineRangeURL", info.RawLineRangeURL("f.go", 3, 5), "https://raw.example.com/a/b/sub/v1.0.0/sub/f.go#3-5"},
+		{"IssueTrackerURL", info.IssueTrackerURL(), "https://bugs.example.com/a/b"},
+		{"CompareURL", info.CompareURL("sub/v0.9.0"), repo + "/compare/sub/v0.9.0..sub/v1.0.0"},
+		{"ReleaseURL", info.ReleaseURL("sub/v1.0.0"), repo + "/releases/sub/v1.0.0"},
+		{"WikiURL", info.WikiURL(), "https://wiki.example.com/b"},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, test.got, test.want)
+		}
+	}
+}
+
+func TestRegisterProviderErrors(t *testing.T) {
+	savePatterns(t)
+
+	n := len(patterns)
+	for _, cfg := range []ProviderConfig{
+		{Pattern: `^(?P<repo>code\.example\.com/[a-z]+`},
+		{Pattern: `^code\.example\.com/[a-z]+`},
+		// Unanchored patterns.
+		{Pattern: `(?P<repo>code\.example\.com/[a-z]+)`},
+		{Pattern: `(?P<repo>^code\.example\.com/[a-z]+)|(?P<other>x)`},
+		{Pattern: `(?m)^(?P<repo>code\.example\.com/[a-z]+)`},
+		{Pattern: `^(?P<repo>code\.example\.com/[a-z]+)`, File: "{repo}/{commit}/{dir}"},
+		{Pattern: `^(?P<repo>code\.example\.com/[a-z]+)`, Issues: "{repo}/issues/{commit}"},
+		{Pattern: `^(?P<repo>code\.example\.com/[a-z]+)`, Line: "{repo}/{file}#L{lines}"},
+		// Groups that the pattern lacks.
+		{Pattern: `^(?P<repo>code\.example\.com/[a-z]+)`, Issues: "https://bugs.example.com/{owner}"},
+		{Pattern: `^(?P<repo>code\.example\.com/(?P<owner>[a-z]+))`, Wiki: "https://wiki.example.com/{owner}/{name}"},
+		// Missing variables.
+		{Pattern: `^(?P<repo>code\.example\.com/[a-z]+)`, File: "{repo}/browse/{commit}"},
+		{Pattern: `^(?P<repo>code\.example\.com/[a-z]+)`, Directory: "{repo}/browse/master/{dir}"},
+		{Pattern: `^(?P<repo>code\.example\.com/[a-z]+)`, Compare: "{repo}/compare/{commit}"},
+		// Complete templates that would build URLs with empty elements, like
+		// "https://code.example.com//browse/...", for want of a name group.
+		{
+			Pattern:   `^(?P<repo>code\.example\.com/(?P<owner>[a-z]+)/[a-z]+)`,
+			Directory: "https://code.example.com/{owner}/{name}/browse/{commit}/{dir}",
+			File:      "https://code.example.com/{owner}/{name}/browse/{commit}/{file}",
+		},
+	} {
+		if err := RegisterProvider(cfg); !errors.Is(err, derrors.InvalidArgument) {
+			t.Errorf("%+v: got error %v, want InvalidArgument", cfg, err)
+		}
+	}
+	if len(patterns) != n {
+		t.Errorf("got %d patterns, want %d", len(patterns), n)
+	}
+}
+
+func TestPrivateHosts(t *testing.T) {
+	savePatterns(t)
+
+	err := RegisterProvider(ProviderConfig{
+		Pattern:   `^(?P<repo>git\.corp\.example\.com/[a-z]+/[a-z]+)`,
+		Directory: "{repo}/tree/{commit}/{dir}",
+		File:      "{repo}/tree/{commit}/{file}",
+		Line:      "{repo}/tree/{commit}/{file}#{line}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClientWithOptions(testTimeout, Options{
+		PrivateHosts: []string{"git.corp.example.com", "*.Internal.example.com", "github.com/corp/"},
+		PathRewrites: []PathRewrite{{From: "proxy.example.com/corp", To: "go.internal.example.com"}},
+		// These would make requests for other hosts.
+		PreferCommitHash: true,
+		CheckTagPrefix:   true,
+		GitHubToken:      "token",
+	})
+	var nRequests int
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		nRequests++
+		return testTransport(nil).RoundTrip(r)
+	})
+	ctx := context.Background()
+
+	// The "v2" directory is assumed not to exist, rather than checked.
+	info, err := ModuleInfo(ctx, client, "git.corp.example.com/team/repo/v2", "v2.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.FileURL("f.go"), "https://git.corp.example.com/team/repo/tree/v2.1.0/f.go"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// No meta tags are fetched for paths that match no pattern, whatever the
+	// case of their hosts, and whether or not they are rewritten.
+	for _, modulePath := range []string{
+		"go.internal.example.com/lib",
+		"Go.Internal.Example.com/lib",
+		"!go.!internal.example.com/lib",
+		"proxy.example.com/corp/lib",
+	} {
+		if _, err := ModuleInfo(ctx, client, modulePath, "v1.0.0"); !errors.Is(err, ErrNoSourceInfo) {
+			t.Errorf("%s: got error %v, want ErrNoSourceInfo", modulePath, err)
+		}
+	}
+	// Nor are the checks made that need requests.
+	if _, err := ModuleInfo(ctx, client, "GitHub.com/corp/repo/v2", "v2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if nRequests != 0 {
+		t.Errorf("got %d requests, want 0", nRequests)
+	}
+}
+
+func TestMatchPrefixPattern(t *testing.T) {
+	for _, test := range []struct {
+		pattern, modulePath string
+		want                bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "example.com/a/b", true},
+		{"example.com", "example.com.evil/a", false},
+		{"*.example.com", "git.example.com/a", true},
+		{"*.example.com", "example.com/a", false},
+		{"example.com/a", "example.com/a/b", true},
+		{"example.com/a/", "example.com/a", true},
+		{"example.com/a", "example.com/ab", false},
+		{"example.com/a/b", "example.com/a", false},
+		{"example.com/*/b", "example.com/x/b/c", true},
+		{"", "example.com", false},
+	} {
+		if got := matchPrefixPattern(test.pattern, test.modulePath); got != test.want {
+			t.Errorf("matchPrefixPattern(%q, %q) = %t, want %t", test.pattern, test.modulePath, got, test.want)
+		}
+	}
+}
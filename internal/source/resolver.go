@@ -0,0 +1,88 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// A Resolver resolves the source information of many modules, as a
+// long-running server does. Unlike a plain Client, it caches the meta tags
+// that it fetches, by module path, so that resolving other versions of a
+// module makes no requests for them. The cache holds the meta tags of the
+// metaCacheSize most recently resolved modules. It shares its other state, like the
+// cache of default branches, across calls. A Resolver is safe for concurrent
+// use.
+//
+// Calls with options set on their context by WithOptions share the Resolver's
+// caches.
+type Resolver struct {
+	client *Client
+}
+
+// metaCacheSize is the number of modules whose meta tags a Resolver caches.
+const metaCacheSize = 10000
+
+// NewResolver returns a Resolver that makes its requests with httpClient and
+// is configured by opts.
+func NewResolver(httpClient *http.Client, opts Options) *Resolver {
+	c := NewClientWithHTTPClient(httpClient, opts)
+	c.state().metaByPath = lru.New(metaCacheSize)
+	return &Resolver{client: c}
+}
+
+// Client returns the Client of r, for passing to the functions of this
+// package that take one. Those functions use r's caches.
+func (r *Resolver) Client() *Client {
+	return r.client
+}
+
+// ModuleInfo is like the function ModuleInfo, using r's client and caches.
+func (r *Resolver) ModuleInfo(ctx context.Context, modulePath, version string) (*Info, error) {
+	return ModuleInfo(ctx, r.client, modulePath, version)
+}
+
+// InfoAtCommit is like the function InfoAtCommit, using r's client and
+// caches.
+func (r *Resolver) InfoAtCommit(ctx context.Context, modulePath, commit string) (*Info, error) {
+	return InfoAtCommit(ctx, r.client, modulePath, commit)
+}
+
+// fetchMeta is like FetchMeta, but uses c's cache of meta tags, if it has
+// one. The caller may modify the result.
+func (c *Client) fetchMeta(ctx context.Context, modulePath string) (*SourceMeta, error) {
+	st := c.state()
+	var (
+		sm *SourceMeta
+		ok bool
+	)
+	st.mu.Lock()
+	if st.metaByPath != nil {
+		var v interface{}
+		if v, ok = st.metaByPath.Get(modulePath); ok {
+			sm = v.(*SourceMeta)
+		}
+	}
+	st.mu.Unlock()
+	if ok {
+		traceFrom(ctx).add("cached", "repo root %q, repo URL %q", sm.RepoRootPrefix, sm.RepoURL)
+		m := *sm
+		return &m, nil
+	}
+	sm, err := FetchMeta(ctx, c, modulePath)
+	if err != nil {
+		return nil, err
+	}
+	st.mu.Lock()
+	if st.metaByPath != nil {
+		m := *sm
+		st.metaByPath.Add(modulePath, &m)
+	}
+	st.mu.Unlock()
+	return sm, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestResolver(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		nRequests int
+	)
+	r := NewResolver(&http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			nRequests++
+			mu.Unlock()
+			return testTransport(testWeb).RoundTrip(req)
+		}),
+		Timeout: testTimeout,
+	}, Options{})
+	ctx := context.Background()
+
+	info, err := r.ModuleInfo(ctx, "heidi.org/pkg", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.RepoURL(), "https://hg.heidi.org/pkg"; got != want {
+		t.Errorf("got repo URL %q, want %q", got, want)
+	}
+	if nRequests != 1 {
+		t.Errorf("got %d requests, want 1", nRequests)
+	}
+
+	// Other versions of the module, and the functions of the package that
+	// are passed r's client, use the cached meta tags.
+	var wg sync.WaitGroup
+	for _, v := range []string{"v1.1.0", "v1.2.0", "v1.3.0"} {
+		wg.Add(1)
+		go func(v string) {
+			defer wg.Done()
+			info, err := r.ModuleInfo(ctx, "heidi.org/pkg", v)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got, want := info.FileURL("f.go"), "https://hg.heidi.org/pkg/file/"+v+"/f.go"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		}(v)
+	}
+	wg.Wait()
+	if _, err := ModuleInfo(ctx, r.Client(), "heidi.org/pkg", "v1.4.0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ModuleInfo(WithOptions(ctx, Options{ShortCommits: true}), "heidi.org/pkg", "v1.5.0"); err != nil {
+		t.Fatal(err)
+	}
+	if nRequests != 1 {
+		t.Errorf("got %d requests after cached resolutions, want 1", nRequests)
+	}
+
+	var tr ResolutionTrace
+	if _, err := r.InfoAtCommit(WithResolutionTrace(ctx, &tr), "heidi.org/pkg", "abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if steps := tr.Steps(); len(steps) == 0 || steps[0].Kind != "cached" {
+		t.Errorf("got steps %v, want a first step of kind %q", steps, "cached")
+	}
+
+	// A module that is not cached is fetched.
+	if _, err := r.ModuleInfo(ctx, "alice.org/pkg", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if nRequests != 2 {
+		t.Errorf("got %d requests, want 2", nRequests)
+	}
+}
+
+func TestResolverCacheSize(t *testing.T) {
+	var nRequests int
+	r := NewResolver(&http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			nRequests++
+			return testTransport(testWeb).RoundTrip(req)
+		}),
+		Timeout: testTimeout,
+	}, Options{})
+	r.client.state().metaByPath.MaxEntries = 1
+	ctx := context.Background()
+	for _, modulePath := range []string{"heidi.org/pkg", "alice.org/pkg", "heidi.org/pkg"} {
+		if _, err := r.ModuleInfo(ctx, modulePath, "v1.0.0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The meta tags of heidi.org/pkg were evicted by those of alice.org/pkg.
+	if nRequests != 3 {
+		t.Errorf("got %d requests, want 3", nRequests)
+	}
+}
@@ -23,17 +23,24 @@ package source
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"path"
+	"path/filepath"
 	"regexp"
+	"regexp/syntax"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/golang/groupcache/lru"
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/trace"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 	"golang.org/x/net/context/ctxhttp"
 	"golang.org/x/pkgsite/internal/derrors"
 	"golang.org/x/pkgsite/internal/log"
@@ -43,13 +50,42 @@ import (
 
 // Info holds source information about a module, used to generate URLs referring
 // to directories, files and lines.
+//
+// An Info may know the repo URL of its module but not how to build URLs for
+// the repo's host. Its URL methods return the empty string for URLs that it
+// has no template for, so callers can detect that no link is available.
+//
+// The paths passed to the URL methods are relative to the module's directory,
+// not to the repo root. A path that begins with the module's directory is not
+// trimmed, because the module may have a subdirectory of the same name; callers
+// with paths relative to the repo root must remove the module's directory.
+// CheckRelativePath catches paths that still have it.
 type Info struct {
 	repoURL   string       // URL of repo containing module; exported for DB schema compatibility
 	moduleDir string       // directory of module relative to repo root
 	commit    string       // tag or ID of commit corresponding to version
+	refKind   refKind      // what commit names, if known
 	templates urlTemplates // for building URLs
 }
 
+// A refKind says whether an Info's commit is a tag, a branch or a commit hash.
+// Names alone cannot tell: a branch may be called "v2" or "cafe123".
+type refKind int
+
+const (
+	unknownRef refKind = iota
+	tagRef
+	branchRef
+	commitRef
+)
+
+// refKindNames are the names of refKinds in the JSON encoding of an Info.
+var refKindNames = map[refKind]string{
+	tagRef:    "tag",
+	branchRef: "branch",
+	commitRef: "commit",
+}
+
 func (i *Info) RepoURL() string {
 	if i == nil {
 		return ""
@@ -67,36 +103,211 @@ func (i *Info) DirectoryURL(dir string) string {
 	if i == nil {
 		return ""
 	}
-	return strings.TrimSuffix(expand(i.templates.Directory, map[string]string{
+	return strings.TrimSuffix(i.expand(i.templates.Directory, map[string]string{
 		"repo":   i.repoURL,
 		"commit": i.commit,
-		"dir":    path.Join(i.moduleDir, dir),
+		"dir":    i.repoPath(dir),
 	}), "/")
 }
 
+// CheckRelativePath returns an error wrapping derrors.InvalidArgument if
+// pathname begins with the module's directory, as a path relative to the repo
+// root does, instead of being relative to the module's directory as the URL
+// methods expect. Such a path is correct only for a module with a
+// subdirectory of the same name as its directory.
+func (i *Info) CheckRelativePath(pathname string) error {
+	if i == nil || i.moduleDir == "" {
+		return nil
+	}
+	if pathname == i.moduleDir || strings.HasPrefix(pathname, i.moduleDir+"/") {
+		return fmt.Errorf("%q begins with module directory %q: %w", pathname, i.moduleDir, derrors.InvalidArgument)
+	}
+	return nil
+}
+
 // FileURL returns a URL for a file whose pathname is relative to the module's home directory.
 func (i *Info) FileURL(pathname string) string {
 	if i == nil {
 		return ""
 	}
-	return expand(i.templates.File, map[string]string{
+	return i.expand(i.templates.File, map[string]string{
 		"repo":   i.repoURL,
 		"commit": i.commit,
-		"file":   path.Join(i.moduleDir, pathname),
+		"file":   i.repoPath(pathname),
 	})
 }
 
+// ReadmeURL returns a URL for the rendered README of a directory relative to
+// the module's home directory. Every host we know of renders a directory's
+// README on the directory's page, so this is usually DirectoryURL(dir); for
+// GitHub, it has an anchor that scrolls to the README.
+func (i *Info) ReadmeURL(dir string) string {
+	u := i.DirectoryURL(dir)
+	if u != "" && i.templates == githubURLTemplates {
+		u += "#readme"
+	}
+	return u
+}
+
+// FileURLAt is like FileURL, but the URL refers to the file at the given tag
+// or commit instead of at the module's commit. For example, it can link to the
+// file as of another version of the module, whose tag is available from
+// another Info's commit. The file may not exist at that commit.
+func (i *Info) FileURLAt(commit, pathname string) string {
+	if i == nil {
+		return ""
+	}
+	j := *i
+	j.commit = commit
+	j.refKind = unknownRef
+	return j.FileURL(pathname)
+}
+
+// SymlinkFileURL returns a URL for the file that a symbolic link refers to,
+// given the path of the link relative to the module's home directory and its
+// target, which is relative to the directory of the link. A URL for the link
+// itself would show only the target's path. Callers must know the target, say
+// from a clone of the repo, since module zip files do not contain symbolic
+// links. If the target is absolute or outside the repo, SymlinkFileURL returns
+// the URL of the link.
+func (i *Info) SymlinkFileURL(pathname, target string) string {
+	if i == nil {
+		return ""
+	}
+	if path.IsAbs(target) {
+		return i.FileURL(pathname)
+	}
+	file := path.Join(path.Dir(i.repoPath(pathname)), target)
+	if file == ".." || strings.HasPrefix(file, "../") {
+		return i.FileURL(pathname)
+	}
+	j := *i
+	j.moduleDir = ""
+	return j.FileURL(file)
+}
+
+// LicenseURL returns a URL for a license file, given its path relative to the
+// module's home directory, as reported by license detection. For a module
+// nested in its repo, the URL refers to the file within the module's directory.
+func (i *Info) LicenseURL(licenseFilePath string) string {
+	return i.FileURL(licenseFilePath)
+}
+
+// repoPath returns the path relative to the repo root of p, which is relative
+// to the module's home directory.
+func (i *Info) repoPath(p string) string {
+	// Special case: before Go 1.4, the packages of the standard library were
+	// in src/pkg, but the commands were in src/cmd.
+	if i.repoURL == stdlib.GoSourceRepoURL && i.moduleDir == "src/pkg" && (p == "cmd" || strings.HasPrefix(p, "cmd/")) {
+		return path.Join("src", p)
+	}
+	return path.Join(i.moduleDir, p)
+}
+
+// PathURL returns DirectoryURL(pathname) if isDir is true, and FileURL(pathname)
+// otherwise. The two kinds of URL differ on most hosts, and there is no URL that
+// works for both, so callers must know which kind of path they have.
+func (i *Info) PathURL(pathname string, isDir bool) string {
+	if isDir {
+		return i.DirectoryURL(pathname)
+	}
+	return i.FileURL(pathname)
+}
+
 // LineURL returns a URL referring to a line in a file relative to the module's home directory.
+// Lines are numbered from 1, and line is used as is; in particular, line
+// numbers in generated files refer to the generated file. If line is less
+// than 1, which is invalid, LineURL returns the URL of the file rather than
+// a link to the wrong line. For lines numbered from 0, use ZeroBasedLineURL.
 func (i *Info) LineURL(pathname string, line int) string {
 	if i == nil {
 		return ""
 	}
-	return expand(i.templates.Line, map[string]string{
+	if line < 1 {
+		return i.FileURL(pathname)
+	}
+	return i.sourceView(pathname, i.expand(i.templates.Line, map[string]string{
 		"repo":   i.repoURL,
 		"commit": i.commit,
-		"file":   path.Join(i.moduleDir, pathname),
+		"file":   i.repoPath(pathname),
 		"line":   strconv.Itoa(line),
-	})
+	}))
+}
+
+// TemplateVars returns the values of the variables that the URL methods
+// substitute into templates, for callers that build URLs with templates of
+// their own. The values are escaped as they are in URLs. The "file" and "dir"
+// variables are both the repo path of pathname; "line" is present if line is
+// positive, and "owner" and "name" if they are known for the repo.
+func (i *Info) TemplateVars(pathname string, line int) map[string]string {
+	if i == nil {
+		return nil
+	}
+	p := escapePath(i.repoPath(pathname))
+	vars := map[string]string{
+		"repo":   i.repoURL,
+		"commit": escapePath(i.commit),
+		"dir":    p,
+		"file":   p,
+	}
+	if line > 0 {
+		vars["line"] = strconv.Itoa(line)
+	}
+	if owner, name := repoOwnerAndName(i.repoURL); owner != "" && name != "" {
+		vars["owner"], vars["name"] = owner, name
+	}
+	return vars
+}
+
+// renderedExtensions are the extensions of files that hosts render, such as
+// Markdown files, instead of showing their source.
+var renderedExtensions = []string{".md", ".markdown", ".rst", ".adoc", ".asciidoc", ".org"}
+
+// sourceView adds to the line URL u of pathname the query parameter that makes
+// the host show the source of the file instead of rendering it, if the host
+// renders files like pathname. Line anchors work only in the source view.
+func (i *Info) sourceView(pathname, u string) string {
+	if i.templates.SourceView == "" || u == "" || !contains(renderedExtensions, strings.ToLower(path.Ext(pathname))) {
+		return u
+	}
+	anchor := ""
+	if k := strings.IndexByte(u, '#'); k >= 0 {
+		u, anchor = u[:k], u[k:]
+	}
+	sep := "?"
+	if strings.Contains(u, "?") {
+		sep = "&"
+	}
+	return u + sep + i.templates.SourceView + anchor
+}
+
+// ZeroBasedLineURL is like LineURL, but line is numbered from 0, as for the
+// line offsets of some tools. If line is negative, it returns the URL of the
+// file.
+func (i *Info) ZeroBasedLineURL(pathname string, line int) string {
+	if line < 0 {
+		return i.FileURL(pathname)
+	}
+	return i.LineURL(pathname, line+1)
+}
+
+// LineRangeURL returns a URL referring to the lines start through end of a file
+// relative to the module's home directory. If the range is a single line, or
+// the repo's host doesn't support ranges, it returns the URL of line start.
+func (i *Info) LineRangeURL(pathname string, start, end int) string {
+	if i == nil {
+		return ""
+	}
+	if end <= start || start < 1 || i.templates.LineRange == "" {
+		return i.LineURL(pathname, start)
+	}
+	return i.sourceView(pathname, i.expand(i.templates.LineRange, map[string]string{
+		"repo":   i.repoURL,
+		"commit": i.commit,
+		"file":   i.repoPath(pathname),
+		"start":  strconv.Itoa(start),
+		"end":    strconv.Itoa(end),
+	}))
 }
 
 // RawURL returns a URL referring to the raw contents of a file relative to the
@@ -106,8 +317,33 @@ func (i *Info) RawURL(pathname string) string {
 	if i == nil {
 		return ""
 	}
+	return i.expandRaw(i.templates.Raw, pathname, nil)
+}
+
+// RawLineRangeURL returns a URL for the raw contents of a file relative to the
+// module's home directory, that also identifies the lines start through end,
+// for tools that embed snippets of code. Raw files are served without
+// regard to the line range, which is in the URL's fragment. If the repo's host
+// has no such URL, or the range is invalid, RawLineRangeURL returns
+// RawURL(pathname).
+func (i *Info) RawLineRangeURL(pathname string, start, end int) string {
+	if i == nil {
+		return ""
+	}
+	if start < 1 || end < start || i.templates.RawLineRange == "" {
+		return i.RawURL(pathname)
+	}
+	return i.expandRaw(i.templates.RawLineRange, pathname, map[string]string{
+		"start": strconv.Itoa(start),
+		"end":   strconv.Itoa(end),
+	})
+}
+
+// expandRaw expands templ, a template for a raw URL, for pathname. vars holds
+// any variables besides the usual ones.
+func (i *Info) expandRaw(templ, pathname string, vars map[string]string) string {
 	// Some templates don't support raw content serving.
-	if i.templates.Raw == "" {
+	if templ == "" || templ == noTemplate {
 		return ""
 	}
 	u, err := url.Parse(i.repoURL)
@@ -127,19 +363,308 @@ func (i *Info) RawURL(pathname string) string {
 	if i.repoURL == stdlib.GoSourceRepoURL {
 		moduleDir = ""
 	}
-	return expand(i.templates.Raw, map[string]string{
+	m := map[string]string{
 		"repo":     i.repoURL,
-		"repoPath": strings.TrimPrefix(u.Path, "/"),
+		"repoPath": strings.TrimPrefix(u.EscapedPath(), "/"),
 		"commit":   i.commit,
 		"file":     path.Join(moduleDir, pathname),
+	}
+	for k, v := range vars {
+		m[k] = v
+	}
+	return i.expand(templ, m)
+}
+
+// IssueTrackerURL returns a URL for the repo's issue tracker, or the empty
+// string if the repo's host does not have one that we know of.
+func (i *Info) IssueTrackerURL() string {
+	if i == nil {
+		return ""
+	}
+	return i.expand(i.templates.Issues, map[string]string{
+		"repo": i.repoURL,
+	})
+}
+
+// WikiURL returns a URL for the repo's wiki, or the empty string if the repo's
+// host does not have wikis that we know of. Like IssueTrackerURL, it does not
+// check that the repo has a wiki.
+func (i *Info) WikiURL() string {
+	if i == nil {
+		return ""
+	}
+	return i.expand(i.templates.Wiki, map[string]string{
+		"repo": i.repoURL,
+	})
+}
+
+// ActionsURL returns a URL for the runs of the repo's GitHub Actions
+// workflows, which are defined by the files in its .github/workflows
+// directory. It returns the empty string for repos not on GitHub.
+func (i *Info) ActionsURL() string {
+	if i == nil {
+		return ""
+	}
+	return i.expand(i.templates.Actions, map[string]string{
+		"repo": i.repoURL,
+	})
+}
+
+// GerritChangeURL returns a URL for the Gerrit code review of a change to the
+// repo, given the change's number, like "12345". It returns the empty string
+// if changeNumber is not a number, or if the repo is not on a Gerrit server we
+// know of. Currently those are the servers for googlesource.com repos, whose
+// reviews are on the host with "-review" added to its first label.
+func (i *Info) GerritChangeURL(changeNumber string) string {
+	if i == nil {
+		return ""
+	}
+	if n, err := strconv.Atoi(changeNumber); err != nil || n <= 0 {
+		return ""
+	}
+	u, err := url.Parse(i.repoURL)
+	if err != nil {
+		return ""
+	}
+	const suffix = ".googlesource.com"
+	if !strings.HasSuffix(u.Host, suffix) {
+		return ""
+	}
+	host := strings.TrimSuffix(u.Host, suffix) + "-review" + suffix
+	project := strings.Trim(u.Path, "/")
+	if project == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://%s/c/%s/+/%s", host, project, changeNumber)
+}
+
+// A RefFormat is a form of the ref returned by Info.Ref.
+type RefFormat int
+
+const (
+	// ShortRef is the form used in URLs, like "v1.2.3" or "main".
+	ShortRef RefFormat = iota
+	// FullRef is the full name of a git ref, like "refs/tags/v1.2.3" or
+	// "refs/heads/main", as some APIs expect.
+	FullRef
+)
+
+// shortHashRegexp matches what may be an abbreviated commit hash.
+var shortHashRegexp = regexp.MustCompile(`^[0-9a-f]{7,39}$`)
+
+// Ref returns the ref that the module's URLs use, in the given format. A
+// commit hash, like that of a pseudo-version, is returned as is in any
+// format. To have URLs use the hashes of tagged commits instead of tags, use
+// Options.PreferCommitHash.
+//
+// The full form of a ref whose kind was not recorded when i was made, as for
+// an Info from NewGitHubInfo, is guessed from its name. If the ref may be
+// either an abbreviated commit hash or a branch, the full form is the empty
+// string, and the caller must resolve the ref itself.
+func (i *Info) Ref(format RefFormat) string {
+	if i == nil || i.commit == "" {
+		return ""
+	}
+	if format != FullRef || i.commit == "HEAD" || strings.HasPrefix(i.commit, "refs/") {
+		return i.commit
+	}
+	kind := i.refKind
+	if kind == unknownRef {
+		kind = guessRefKind(i.commit)
+	}
+	switch kind {
+	case tagRef:
+		return "refs/tags/" + i.commit
+	case branchRef:
+		return "refs/heads/" + i.commit
+	case commitRef:
+		return i.commit
+	default:
+		return ""
+	}
+}
+
+// guessRefKind returns the kind of ref that name appears to be, or unknownRef
+// if it may be either a branch or an abbreviated commit hash.
+func guessRefKind(name string) refKind {
+	switch {
+	case fullCommitRegexp.MatchString(name):
+		return commitRef
+	case shortHashRegexp.MatchString(name):
+		return unknownRef
+	case isTagName(path.Base(name)):
+		// Tags are versions, with a directory prefix for nested modules,
+		// and perhaps without the "v".
+		return tagRef
+	default:
+		return branchRef
+	}
+}
+
+// forgetGuessableRefKind clears i's record of the kind of its commit if the
+// kind can be guessed from the commit's name, so that i compares equal to an
+// Info made by NewGitHubInfo or the like.
+func (i *Info) forgetGuessableRefKind() {
+	if i.refKind == guessRefKind(i.commit) {
+		i.refKind = unknownRef
+	}
+}
+
+// isTagName reports whether name is a complete semantic version, perhaps
+// without the "v", as tags are. Short forms like "v2" are taken to be branch
+// names.
+func isTagName(name string) bool {
+	v := strings.TrimSuffix(name, "+incompatible")
+	if !strings.HasPrefix(v, "v") {
+		v = "v" + v
+	}
+	return semver.Canonical(v) == v
+}
+
+// CompareURL returns a URL for the differences between otherCommit and the
+// commit of i, or the empty string if the repo's host is not known to support
+// such URLs.
+func (i *Info) CompareURL(otherCommit string) string {
+	if i == nil {
+		return ""
+	}
+	return i.expand(i.templates.Compare, map[string]string{
+		"repo":        i.repoURL,
+		"commit":      i.commit,
+		"otherCommit": otherCommit,
+	})
+}
+
+// LogURL returns a URL for the history of the repo, ending at the commit of
+// i, or the empty string if the repo's host is not known to support such URLs.
+func (i *Info) LogURL() string {
+	if i == nil {
+		return ""
+	}
+	return i.expand(i.templates.Log, map[string]string{
+		"repo":   i.repoURL,
+		"commit": i.commit,
 	})
 }
 
+// DirectoryLogURL is like LogURL, but for the history of a directory relative
+// to the module's home directory. It returns the empty string if the repo's
+// host is not known to support logs of directories.
+func (i *Info) DirectoryLogURL(dir string) string {
+	if i == nil {
+		return ""
+	}
+	p := i.repoPath(dir)
+	if p == "" {
+		return i.LogURL()
+	}
+	return i.expand(i.templates.DirectoryLog, map[string]string{
+		"repo":   i.repoURL,
+		"commit": i.commit,
+		"dir":    p,
+	})
+}
+
+// ReleaseURL returns a URL for the release page of the given tag, which
+// typically holds release notes. Unlike a URL for the tag's tree, it exists
+// only if a release was created for the tag, and only on hosts that support
+// releases. ReleaseURL returns the empty string for other hosts.
+func (i *Info) ReleaseURL(tag string) string {
+	if i == nil {
+		return ""
+	}
+	return i.expand(i.templates.Release, map[string]string{
+		"repo": i.repoURL,
+		"tag":  tag,
+	})
+}
+
+// ReleasesFeedURL returns a URL for an Atom feed of the repo's releases, or
+// the empty string if the repo's host does not have one that we know of.
+func (i *Info) ReleasesFeedURL() string {
+	if i == nil {
+		return ""
+	}
+	return i.expand(i.templates.ReleasesFeed, map[string]string{
+		"repo": i.repoURL,
+	})
+}
+
+// TagsFeedURL is like ReleasesFeedURL, for a feed of the repo's tags.
+func (i *Info) TagsFeedURL() string {
+	if i == nil {
+		return ""
+	}
+	return i.expand(i.templates.TagsFeed, map[string]string{
+		"repo": i.repoURL,
+	})
+}
+
+// GitHubSlug returns the "owner/repo" slug of the module's repo, as used by
+// badge services like shields.io, and reports whether the repo is on GitHub.
+func (i *Info) GitHubSlug() (string, bool) {
+	if i == nil || i.templates != githubURLTemplates || !strings.HasPrefix(i.repoURL, "https://github.com/") {
+		return "", false
+	}
+	owner, name := repoOwnerAndName(i.repoURL)
+	if owner == "" || name == "" {
+		return "", false
+	}
+	return owner + "/" + name, true
+}
+
+// A Submodule describes a git submodule of the repo containing a module, as
+// recorded in the repo's .gitmodules file.
+type Submodule struct {
+	Path    string // directory of the submodule, relative to the repo root
+	RepoURL string // URL of the submodule's repo, or "" if unknown
+	Commit  string // commit of the submodule recorded in the containing repo
+}
+
+// SubmoduleFileURL is like FileURL, but takes into account that pathname may
+// lie inside one of the given submodules. Files in a submodule are not part of
+// the containing repo, so a URL built from the containing repo would be
+// broken. If pathname is inside a submodule whose repo is at a known host,
+// SubmoduleFileURL returns a URL relative to that repo. If the submodule's repo
+// is unknown or at a host we don't have templates for, it returns the empty
+// string. If pathname is not in any submodule, it returns i.FileURL(pathname).
+func (i *Info) SubmoduleFileURL(pathname string, submodules []Submodule) string {
+	if i == nil {
+		return ""
+	}
+	file := i.repoPath(pathname)
+	for _, s := range submodules {
+		dir := strings.Trim(s.Path, "/")
+		if dir == "" || !strings.HasPrefix(file, dir+"/") {
+			continue
+		}
+		if s.RepoURL == "" {
+			return ""
+		}
+		repo, _, templates, err := matchStatic(removeHTTPScheme(strings.TrimSuffix(s.RepoURL, ".git")))
+		if err != nil || templates.File == "" {
+			return ""
+		}
+		sub := &Info{
+			repoURL:   "https://" + repo,
+			commit:    s.Commit,
+			templates: templates,
+		}
+		return sub.FileURL(strings.TrimPrefix(file, dir+"/"))
+	}
+	return i.FileURL(pathname)
+}
+
 // map of common urlTemplates
 var urlTemplatesByKind = map[string]urlTemplates{
-	"github":    githubURLTemplates,
-	"gitlab":    gitlabURLTemplates,
-	"bitbucket": bitbucketURLTemplates,
+	"github":      githubURLTemplates,
+	"gitlab":      gitlabURLTemplates,
+	"bitbucket":   bitbucketURLTemplates,
+	"gitea":       giteaURLTemplates,
+	"gogs":        gogsURLTemplates,
+	"sourcehut":   sourcehutURLTemplates,
+	"phabricator": phabricatorURLTemplates,
+	"cgit":        cgitURLTemplates,
 }
 
 // jsonInfo is a Go struct describing the JSON structure of an INFO.
@@ -147,6 +672,7 @@ type jsonInfo struct {
 	RepoURL   string
 	ModuleDir string
 	Commit    string
+	RefKind   string `json:",omitempty"`
 	// Store common templates efficiently by setting this to a short string
 	// we look up in a map. If Kind != "", then Templates == nil.
 	Kind      string        `json:",omitempty"`
@@ -161,6 +687,7 @@ func (i *Info) MarshalJSON() (_ []byte, err error) {
 		RepoURL:   i.repoURL,
 		ModuleDir: i.moduleDir,
 		Commit:    i.commit,
+		RefKind:   refKindNames[i.refKind],
 	}
 	// Store common templates efficiently, by name.
 	for kind, templs := range urlTemplatesByKind {
@@ -185,6 +712,12 @@ func (i *Info) UnmarshalJSON(data []byte) (err error) {
 	i.repoURL = ji.RepoURL
 	i.moduleDir = ji.ModuleDir
 	i.commit = ji.Commit
+	i.refKind = unknownRef
+	for kind, name := range refKindNames {
+		if ji.RefKind == name {
+			i.refKind = kind
+		}
+	}
 	if ji.Kind != "" {
 		i.templates = urlTemplatesByKind[ji.Kind]
 	} else if ji.Templates != nil {
@@ -193,18 +726,314 @@ func (i *Info) UnmarshalJSON(data []byte) (err error) {
 	return nil
 }
 
+// ErrRequestBudgetExceeded indicates that resolving source information would
+// take more requests than permitted by Options.MaxRequests.
+var ErrRequestBudgetExceeded = errors.New("request budget exceeded")
+
+// ErrRateLimited indicates that a host refused a request because too many
+// had been made. If the host's response had a Retry-After header, requests to
+// the host fail with ErrRateLimited, without being made, until the time it
+// gives has passed.
+var ErrRateLimited = errors.New("rate limited")
+
+// ErrNoSourceInfo indicates that no source information could be determined
+// for a module. It wraps derrors.NotFound.
+var ErrNoSourceInfo = fmt.Errorf("no source info: %w", derrors.NotFound)
+
 type Client struct {
 	// client used for HTTP requests. It is mutable for testing purposes.
 	httpClient *http.Client
+	opts       Options
+
+	// Base URL of the GitHub API. It is mutable for testing purposes.
+	githubAPIURL string
+
+	stateOnce sync.Once
+	st        *clientState
+}
+
+// clientState is the mutable state of a Client. The clients made from a
+// Client for the options of a context, by withOptions, share it.
+type clientState struct {
+	mu               sync.Mutex
+	branchesByURL    map[string]string    // cache of default branches, by repo URL
+	rateLimitedUntil map[string]time.Time // by host, from Retry-After headers
+	metaByPath       *lru.Cache           // cache of *SourceMeta, by module path; nil if none
+}
+
+// state returns the state of c, creating it if necessary.
+func (c *Client) state() *clientState {
+	c.stateOnce.Do(func() {
+		if c.st == nil {
+			c.st = &clientState{}
+		}
+	})
+	return c.st
+}
+
+// Options configure a Client. The zero value is valid.
+type Options struct {
+	// GitHubToken, if non-empty, is used to authenticate calls to the GitHub API.
+	GitHubToken string
+	// GitLabToken, if non-empty, is used to authenticate calls to the GitLab API.
+	GitLabToken string
+	// PreferCommitHash, if true, causes URLs for tagged versions to use the
+	// ID of the tagged commit instead of the tag, so that they refer to the
+	// same files even if the tag is moved. Tags are resolved with the API of
+	// the repo's host, which requires a token. If a tag can't be resolved, the
+	// tag is used.
+	PreferCommitHash bool
+	// CommitResolver, if non-nil, is used instead of the API and web pages of
+	// repos' hosts to resolve tags and find default branches.
+	CommitResolver CommitResolver
+	// Insecure, if true, keeps repo URLs from meta tags that begin with
+	// "http://". Otherwise, such repo URLs are changed to use https. It is
+	// meant for testing against hosts without TLS.
+	Insecure bool
+	// ShortCommits, if true, causes full commit IDs in URLs to be shortened
+	// to a length of 12 on hosts that accept abbreviated IDs. Hosts that
+	// may not, like googlesource.com, get the full ID.
+	ShortCommits bool
+	// DefaultRef is the ref used in URLs for repos on git hosts when no
+	// commit can be determined from the version, as when it is empty. If
+	// DefaultRef is empty, "HEAD", which git hosts take to mean the tip of the
+	// default branch, is used. Mercurial repos served by hgweb use "tip", and
+	// repos on other hosts no ref.
+	DefaultRef string
+	// CheckTagPrefix, if true, causes a request to check that the tag of a
+	// tagged version exists. If it doesn't, but a tag without the leading "v"
+	// does, as for repos that tag releases like "1.2.3", URLs use that tag.
+	CheckTagPrefix bool
+	// FollowRepoRedirects, if true, causes the repo URLs of GitHub repos to be
+	// replaced by the target of a redirect from them, so that renamed or
+	// transferred repos are shown under their current names. It costs a request
+	// per module.
+	FollowRepoRedirects bool
+	// AllowedHosts, if non-empty, lists the only hosts from which meta tags may
+	// be fetched, or for which RepoHint is called, for module paths that do
+	// not match a known pattern.
+	AllowedHosts []string
+	// DeniedHosts lists hosts from which meta tags must not be fetched, and for
+	// which RepoHint is not called. It takes precedence over AllowedHosts.
+	// Hosts in either list match without regard to case.
+	DeniedHosts []string
+	// PrivateHosts lists patterns for the module paths of private repos, whose
+	// modules must be resolved without requests. They are matched like the
+	// patterns of GOPRIVATE: each is a glob pattern, like "*.corp.example.com"
+	// or "github.com/corp", that matches a prefix of a module path with as many
+	// path elements. Hosts are matched without regard to case. Matching
+	// module paths are resolved only from known patterns, including those
+	// added with RegisterProvider, as with StaticOnly.
+	PrivateHosts []string
+	// PathRewrites are applied to module paths before they are resolved, to
+	// map paths served by a private proxy to their public equivalents. The
+	// first one that matches is used.
+	PathRewrites []PathRewrite
+	// WellKnownRewrites, if true, causes module paths on some popular vanity
+	// hosts, like go.uber.org, to be mapped to the repos that their go-import
+	// meta tags name, without fetching the tags. PathRewrites take precedence.
+	// The mappings are correct as of this writing, but a host may change its
+	// meta tags; only the tags are authoritative.
+	WellKnownRewrites bool
+	// RepoHint, if non-nil, is called for a module path that does not match a
+	// known pattern, before its meta tags are fetched. If it returns non-nil
+	// meta tag information, as from a mirror that records the upstream repos of
+	// its modules, that information is used and meta tags are not fetched.
+	// Like fetched information, its repo root prefix must be a prefix of the
+	// module path.
+	RepoHint func(ctx context.Context, modulePath string) (*SourceMeta, error)
+	// BrowseHosts maps the hosts of repo URLs to the hosts of their web pages,
+	// for servers that are cloned from one host, like "git.internal", and
+	// browsed on another, like "browse.internal". Repo URLs are resolved with
+	// the first host, and URLs built from them use the second.
+	BrowseHosts map[string]string
+	// RepoBaseURL, if non-empty, replaces the scheme and host of the repo URLs
+	// of resolved modules, and so of the URLs built from them. It is intended
+	// for tests and for serving links to a local mirror, like
+	// "http://localhost:8080/mirror". URLs that do not begin with the repo URL,
+	// like GitHub raw URLs, are not changed.
+	RepoBaseURL string
+	// MaxRedirects, if positive, is the most redirects followed by a request.
+	// Otherwise the policy of the HTTP client is used, which by default is to
+	// stop after 10 requests.
+	MaxRedirects int
+	// MaxRequests, if positive, is the most HTTP requests, including
+	// redirects, that a call to ModuleInfo may make. Requests beyond it fail
+	// with an error wrapping ErrRequestBudgetExceeded.
+	MaxRequests int
+	// MaxResolveTime, if positive, bounds the time a call to ModuleInfo may
+	// take.
+	MaxResolveTime time.Duration
+	// StaticOnly, if true, causes ModuleInfo to make no requests, as if it
+	// were passed a nil client. Only module paths that match known patterns
+	// are resolved, and options that need requests have no effect.
+	StaticOnly bool
+}
+
+type optionsKey struct{}
+
+// WithOptions returns a context that causes ModuleInfo, and the other
+// functions of this package that resolve modules, to use opts in place of the
+// options of the client they are passed. It lets callers configure a single
+// resolution without constructing a Client. The caches and other state of the
+// client, like the hosts that have limited the rate of its requests, are still
+// used.
+func WithOptions(ctx context.Context, opts Options) context.Context {
+	return context.WithValue(ctx, optionsKey{}, opts)
+}
+
+// withOptions returns a client like c, but with opts. It shares c's HTTP
+// client and state, like its caches and the hosts that have limited its rate.
+// If c is nil, the new client makes no requests.
+func (c *Client) withOptions(opts Options) *Client {
+	if c == nil {
+		opts.StaticOnly = true
+		return &Client{opts: opts}
+	}
+	return &Client{
+		httpClient:   c.httpClient,
+		opts:         opts,
+		githubAPIURL: c.githubAPIURL,
+		st:           c.state(),
+	}
+}
+
+// A PathRewrite replaces a prefix of a module path. The prefix must consist of
+// whole path elements.
+type PathRewrite struct {
+	From string // prefix to replace, like "proxy.corp.example.com/github.com"
+	To   string // replacement, like "github.com"
+}
+
+// rewritePath applies the first of c's path rewrites that matches modulePath.
+// If none do, and c's options permit, it applies the first of
+// wellKnownRewrites that does.
+func (c *Client) rewritePath(modulePath string) string {
+	if c == nil {
+		return modulePath
+	}
+	if p, ok := applyRewrites(c.opts.PathRewrites, modulePath); ok {
+		return p
+	}
+	if !c.opts.WellKnownRewrites {
+		return modulePath
+	}
+	p, _ := applyRewrites(wellKnownRewrites, modulePath)
+	return p
+}
+
+// applyRewrites applies the first of rewrites that matches modulePath, and
+// reports whether any did.
+func applyRewrites(rewrites []PathRewrite, modulePath string) (string, bool) {
+	for _, r := range rewrites {
+		from := strings.TrimSuffix(r.From, "/")
+		if modulePath == from || strings.HasPrefix(modulePath, from+"/") {
+			return strings.TrimSuffix(r.To, "/") + modulePath[len(from):], true
+		}
+	}
+	return modulePath, false
+}
+
+// wellKnownRewrites map the paths of some popular vanity hosts to the repos
+// that their go-import meta tags point to, saving a fetch. For hosts whose
+// repos hold several modules, the rest of the module path is the module's
+// directory in the repo. They are used only with Options.WellKnownRewrites.
+//
+// The golang.org/x repos are not here: their go-import tags name
+// go.googlesource.com, whose repo paths cannot be told apart from module
+// directories, so they are resolved from their meta tags.
+var wellKnownRewrites = []PathRewrite{
+	{From: "cloud.google.com/go", To: "github.com/googleapis/google-cloud-go"},
+	{From: "go.uber.org", To: "github.com/uber-go"},
+	{From: "gocloud.dev", To: "github.com/google/go-cloud"},
+	{From: "golang.org/dl", To: "go.googlesource.com/dl"},
+	{From: "k8s.io", To: "github.com/kubernetes"},
+}
+
+// allowsHost reports whether c's options permit fetching meta tags from host.
+// Host names are compared without regard to case.
+func (c *Client) allowsHost(host string) bool {
+	if c == nil {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, h := range c.opts.DeniedHosts {
+		if strings.ToLower(h) == host {
+			return false
+		}
+	}
+	if len(c.opts.AllowedHosts) == 0 {
+		return true
+	}
+	for _, h := range c.opts.AllowedHosts {
+		if strings.ToLower(h) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivate reports whether modulePath matches one of the PrivateHosts
+// patterns of c's options. c may be nil.
+func (c *Client) isPrivate(modulePath string) bool {
+	if c == nil {
+		return false
+	}
+	for _, p := range c.opts.PrivateHosts {
+		if matchPrefixPattern(lowercaseHost(p), modulePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPrefixPattern reports whether the glob pattern matches a prefix of
+// modulePath with as many path elements, as the go command matches the
+// patterns of GOPRIVATE. A trailing slash of the pattern is ignored.
+func matchPrefixPattern(pattern, modulePath string) bool {
+	pattern = strings.TrimSuffix(strings.TrimSpace(pattern), "/")
+	if pattern == "" {
+		return false
+	}
+	n := strings.Count(pattern, "/")
+	prefix := modulePath
+	for i := 0; i < len(modulePath); i++ {
+		if modulePath[i] == '/' {
+			if n == 0 {
+				prefix = modulePath[:i]
+				break
+			}
+			n--
+		}
+	}
+	if n > 0 {
+		// The path has fewer elements than the pattern.
+		return false
+	}
+	matched, _ := path.Match(pattern, prefix)
+	return matched
 }
 
 // New constructs a *Client using the provided timeout.
 func NewClient(timeout time.Duration) *Client {
+	return NewClientWithOptions(timeout, Options{})
+}
+
+// NewClientWithOptions constructs a *Client using the provided timeout and
+// options.
+func NewClientWithOptions(timeout time.Duration, opts Options) *Client {
+	return NewClientWithHTTPClient(&http.Client{
+		Transport: &ochttp.Transport{},
+		Timeout:   timeout,
+	}, opts)
+}
+
+// NewClientWithHTTPClient constructs a *Client that makes all its requests
+// with httpClient, and so uses its transport, including any proxy settings.
+func NewClientWithHTTPClient(httpClient *http.Client, opts Options) *Client {
 	return &Client{
-		httpClient: &http.Client{
-			Transport: &ochttp.Transport{},
-			Timeout:   timeout,
-		},
+		httpClient: httpClient,
+		opts:       opts,
 	}
 }
 
@@ -221,56 +1050,401 @@ func (c *Client) doURL(ctx context.Context, method, url string, only200 bool) (_
 	if err != nil {
 		return nil, err
 	}
-	resp, err := ctxhttp.Do(ctx, c.httpClient, req)
+	resp, err := c.do(ctx, req, true)
+	if err != nil {
+		return nil, err
+	}
+	if only200 && resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// do sends req with c's HTTP client, following redirects if followRedirects is
+// true. The request and its redirects are subject to c's limits on redirects
+// and to the request budget in ctx, if any.
+func (c *Client) do(ctx context.Context, req *http.Request, followRedirects bool) (*http.Response, error) {
+	host := req.URL.Host
+	st := c.state()
+	st.mu.Lock()
+	until := st.rateLimitedUntil[host]
+	st.mu.Unlock()
+	if time.Now().Before(until) {
+		return nil, fmt.Errorf("%s until %s: %w", host, until.Format(time.RFC3339), ErrRateLimited)
+	}
+	budget, _ := ctx.Value(requestBudgetKey{}).(*requestBudget)
+	if err := budget.take(); err != nil {
+		return nil, err
+	}
+	tr := traceFrom(ctx)
+	tr.add("fetch", "%s %s", req.Method, req.URL)
+	hc := *c.httpClient
+	hc.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !followRedirects {
+			return http.ErrUseLastResponse
+		}
+		tr.add("redirect", "%s", req.URL)
+		if max := c.opts.MaxRedirects; max > 0 && len(via) > max {
+			return fmt.Errorf("stopped after %d redirects", max)
+		}
+		if check := c.httpClient.CheckRedirect; check != nil {
+			if err := check(req, via); err != nil {
+				return err
+			}
+		} else if len(via) >= 10 {
+			// The default policy of http.Client.
+			return errors.New("stopped after 10 redirects")
+		}
+		return budget.take()
+	}
+	resp, err := ctxhttp.Do(ctx, &hc, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		resp.Body.Close()
+		if d, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			st.mu.Lock()
+			if st.rateLimitedUntil == nil {
+				st.rateLimitedUntil = map[string]time.Time{}
+			}
+			st.rateLimitedUntil[host] = time.Now().Add(d)
+			st.mu.Unlock()
+		}
+		return nil, fmt.Errorf("%s: %s: %w", host, resp.Status, ErrRateLimited)
+	}
+	return resp, nil
+}
+
+// retryAfter returns the duration to wait given by the value of a Retry-After
+// header, which is either a number of seconds or a time, and reports whether
+// the value is valid.
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		if n < 0 {
+			return 0, false
+		}
+		return time.Duration(n) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return t.Sub(now), true
+}
+
+type requestBudgetKey struct{}
+
+// A requestBudget limits the number of requests made for one call to
+// ModuleInfo.
+type requestBudget struct {
+	mu        sync.Mutex
+	max, used int
+}
+
+// take uses up one request of b, or fails if there are none left. A nil budget
+// is unlimited.
+func (b *requestBudget) take() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used >= b.max {
+		return fmt.Errorf("more than %d requests: %w", b.max, ErrRequestBudgetExceeded)
+	}
+	b.used++
+	return nil
+}
+
+// ModuleInfo determines the repository corresponding to the module path. It
+// returns a URL to that repo, as well as the directory of the module relative
+// to the repo root.
+//
+// modulePath must be the path of a module, not of a package within one. A
+// module nested in a repo with other modules has its own directory and tags
+// (like "sub/v1.2.3"), which ModuleInfo uses. For a package within a module, use
+// the Info of its module and pass the package's path relative to the module
+// to DirectoryURL or FileURL; those links use the module's commit.
+//
+// ModuleInfo may fetch from arbitrary URLs, so it can be slow. If client is
+// nil, it makes no requests, and resolves only module paths that match known
+// patterns; for others it returns an error wrapping ErrNoSourceInfo. Options
+// set on ctx with WithOptions replace those of client.
+func ModuleInfo(ctx context.Context, client *Client, modulePath, version string) (info *Info, err error) {
+	defer derrors.Wrap(&err, "source.LegacyModuleInfo(ctx, %q, %q)", modulePath, version)
+	ctx, span := trace.StartSpan(ctx, "source.LegacyModuleInfo")
+	defer span.End()
+
+	return moduleInfo(ctx, client, modulePath, version, "")
+	// TODO(b/141770842): support launchpad.net, including the special case in cmd/go/internal/get/vcs.go.
+}
+
+// InfoAtCommit is like ModuleInfo, but its URLs refer to the given commit,
+// which is used as is, instead of one derived from a version. The commit may
+// be anything the repo's host accepts in URLs, like a full or abbreviated
+// commit hash.
+func InfoAtCommit(ctx context.Context, client *Client, modulePath, commit string) (info *Info, err error) {
+	defer derrors.Wrap(&err, "source.InfoAtCommit(ctx, %q, %q)", modulePath, commit)
+
+	if commit == "" {
+		return nil, fmt.Errorf("empty commit: %w", derrors.InvalidArgument)
+	}
+	return moduleInfo(ctx, client, modulePath, "", commit)
+}
+
+// CompareInfo returns the Info of the module at toVersion, like ModuleInfo,
+// along with the commits for fromVersion and toVersion, for building a link to
+// the changes between them with the Info's CompareURL. It resolves the module
+// once for each version, so it may make twice the requests of ModuleInfo.
+func CompareInfo(ctx context.Context, client *Client, modulePath, fromVersion, toVersion string) (_ *Info, fromCommit, toCommit string, err error) {
+	defer derrors.Wrap(&err, "source.CompareInfo(ctx, %q, %q, %q)", modulePath, fromVersion, toVersion)
+
+	from, err := moduleInfo(ctx, client, modulePath, fromVersion, "")
+	if err != nil {
+		return nil, "", "", err
+	}
+	to, err := moduleInfo(ctx, client, modulePath, toVersion, "")
+	if err != nil {
+		return nil, "", "", err
+	}
+	if from.repoURL != to.repoURL {
+		return nil, "", "", fmt.Errorf("versions are in different repos, %q and %q: %w", from.repoURL, to.repoURL, derrors.NotFound)
+	}
+	return to, from.commit, to.commit, nil
+}
+
+// moduleInfo implements ModuleInfo and InfoAtCommit. If commit is empty, the
+// commit is derived from version; otherwise version is ignored.
+func moduleInfo(ctx context.Context, client *Client, modulePath, version, commit string) (info *Info, err error) {
+	if opts, ok := ctx.Value(optionsKey{}).(Options); ok {
+		client = client.withOptions(opts)
+	}
+	if client != nil && client.opts.MaxRequests > 0 {
+		ctx = context.WithValue(ctx, requestBudgetKey{}, &requestBudget{max: client.opts.MaxRequests})
+	}
+	if client != nil && client.opts.MaxResolveTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.opts.MaxResolveTime)
+		defer cancel()
+	}
+	modulePath, err = unescapeModulePath(modulePath)
+	if err != nil {
+		return nil, err
+	}
+	modulePath = lowercaseHost(modulePath)
+	// Both the path and its rewritten form must be public for requests to be
+	// made.
+	private := client.isPrivate(modulePath)
+	modulePath = client.rewritePath(modulePath)
+	private = private || client.isPrivate(modulePath)
+	version, err = unescapeVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	// requester makes the requests of resolution. It is nil if none may be
+	// made.
+	requester := client
+	if client != nil && (client.opts.StaticOnly || private) {
+		requester = nil
+	}
+	if modulePath == stdlib.ModulePath || modulePath == cmdModulePath {
+		if commit != "" {
+			// Assume a commit from after the move of src/pkg to src.
+			info = &Info{
+				repoURL:   stdlib.GoSourceRepoURL,
+				moduleDir: "src",
+				commit:    commit,
+				templates: githubURLTemplates,
+			}
+		} else if info, err = stdlibInfo(version); err != nil {
+			return nil, err
+		}
+		if modulePath == cmdModulePath {
+			// The commands have always been in src/cmd.
+			info.moduleDir = "src/cmd"
+		}
+		return info, nil
+	}
+	repo, relativeModulePath, templates, err := matchStatic(modulePath)
+	if err != nil {
+		info, err = moduleInfoDynamic(ctx, requester, modulePath, version)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		traceFrom(ctx).add("pattern", "%s matches repo %q", modulePath, repo)
+		traceTemplates(ctx, templates)
+		info = &Info{
+			repoURL:   "https://" + repo,
+			moduleDir: relativeModulePath,
+			commit:    commitFromVersion(version, relativeModulePath),
+			refKind:   versionRefKind(version),
+			templates: templates,
+		}
+	}
+	if commit != "" {
+		info.commit = commit
+		info.refKind = unknownRef
+	}
+	if info.commit == "" {
+		info.commit = client.defaultRef(info.templates)
+		info.refKind = branchRef
+	}
+	if requester != nil && requester.opts.FollowRepoRedirects {
+		requester.followRepoRedirect(ctx, info)
+	}
+	adjustVersionedModuleDirectory(ctx, requester, info)
+	if requester != nil && requester.opts.CheckTagPrefix && commit == "" {
+		requester.checkTagPrefix(ctx, info, version)
+	}
+	if requester != nil && requester.opts.PreferCommitHash && commit == "" {
+		requester.resolveTag(ctx, info, version)
+	}
+	if client != nil && client.opts.ShortCommits {
+		info.commit = shortenCommit(info.commit, info.templates)
+	}
+	if client != nil && len(client.opts.BrowseHosts) > 0 {
+		info.repoURL = browseURL(info.repoURL, client.opts.BrowseHosts)
+	}
+	if client != nil && client.opts.RepoBaseURL != "" {
+		info.repoURL = rebaseURL(info.repoURL, client.opts.RepoBaseURL)
+	}
+	info.forgetGuessableRefKind()
+	return info, nil
+}
+
+// ModuleInfoWithCanonicalPath is like ModuleInfo, but resolves the source of
+// the module using canonicalPath instead of modulePath, if canonicalPath is
+// non-empty. The canonical path is the one declared by the code itself, as by an
+// import comment like
+//   package foo // import "example.com/foo"
+// and may differ from the path the module was fetched by.
+func ModuleInfoWithCanonicalPath(ctx context.Context, client *Client, modulePath, canonicalPath, version string) (*Info, error) {
+	if canonicalPath != "" && canonicalPath != modulePath {
+		log.Infof(ctx, "source.ModuleInfoWithCanonicalPath: using %q for %q", canonicalPath, modulePath)
+		modulePath = canonicalPath
+	}
+	return ModuleInfo(ctx, client, modulePath, version)
+}
+
+// traceTemplates records the choice of templates in the trace of ctx.
+func traceTemplates(ctx context.Context, templates urlTemplates) {
+	tr := traceFrom(ctx)
+	if tr == nil {
+		return
+	}
+	kind := "custom"
+	if templates == (urlTemplates{}) {
+		kind = "none"
+	}
+	for k, t := range urlTemplatesByKind {
+		if t == templates {
+			kind = k
+			break
+		}
+	}
+	tr.add("templates", "%s", kind)
+}
+
+// defaultRef returns the ref to use with templates when there is no commit,
+// or the empty string if there is none. c may be nil.
+func (c *Client) defaultRef(templates urlTemplates) string {
+	if templates.Raw == hgwebRawTemplate {
+		return "tip"
+	}
+	for _, t := range gitURLTemplates {
+		if templates == t {
+			if c != nil && c.opts.DefaultRef != "" {
+				return c.opts.DefaultRef
+			}
+			return "HEAD"
+		}
+	}
+	return ""
+}
+
+// cmdModulePath is the path of the module of the Go commands, which is in the
+// same repo as the standard library.
+const cmdModulePath = "cmd"
+
+// stdlibInfo returns an Info for the standard library at the given version.
+func stdlibInfo(version string) (*Info, error) {
+	// The Go repo's history goes back before Go 1, but release tags that
+	// correspond to semantic versions begin at go1.
+	if semver.IsValid(version) && semver.Compare(version, "v1.0.0") < 0 {
+		return nil, fmt.Errorf("Go version %q predates Go 1: %w", version, derrors.NotFound)
+	}
+	commit, err := stdlib.TagForVersion(version)
 	if err != nil {
-		return nil, err
-	}
-	if only200 && resp.StatusCode != 200 {
-		resp.Body.Close()
-		return nil, fmt.Errorf("status %s", resp.Status)
+		// Keep the classification of err: a malformed version is an invalid
+		// argument, while one that doesn't name a Go release is not found.
+		return nil, fmt.Errorf("no Go release tag for version %q: %w", version, err)
 	}
-	return resp, nil
+	return &Info{
+		repoURL:   stdlib.GoSourceRepoURL,
+		moduleDir: stdlib.Directory(version),
+		commit:    commit,
+		templates: githubURLTemplates,
+	}, nil
 }
 
-// LegacyModuleInfo determines the repository corresponding to the module path. It
-// returns a URL to that repo, as well as the directory of the module relative
-// to the repo root.
+// RepoRootPrefix returns the prefix of modulePath that corresponds to the root
+// of its repo, if that can be determined without making any network requests.
+// The second return value reports whether it could be.
 //
-// LegacyModuleInfo may fetch from arbitrary URLs, so it can be slow.
-func ModuleInfo(ctx context.Context, client *Client, modulePath, version string) (info *Info, err error) {
-	defer derrors.Wrap(&err, "source.LegacyModuleInfo(ctx, %q, %q)", modulePath, version)
-	ctx, span := trace.StartSpan(ctx, "source.LegacyModuleInfo")
-	defer span.End()
+// For example, the repo root prefix of "github.com/a/b/c" is "github.com/a/b",
+// and that of "example.com/a/b.git/c" is "example.com/a/b.git".
+func RepoRootPrefix(modulePath string) (string, bool) {
+	_, relativeModulePath, _, err := matchStatic(modulePath)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(modulePath, relativeModulePath), "/"), true
+}
 
-	if modulePath == stdlib.ModulePath {
-		commit, err := stdlib.TagForVersion(version)
-		if err != nil {
-			return nil, err
-		}
-		return &Info{
-			repoURL:   stdlib.GoSourceRepoURL,
-			moduleDir: stdlib.Directory(version),
-			commit:    commit,
-			templates: githubURLTemplates,
-		}, nil
+// unescapeModulePath undoes any percent-encoding of modulePath, which can
+// happen when the path has been taken from a URL, such as a module proxy
+// request. This is distinct from the "!" encoding of upper-case letters used
+// by the proxy protocol (see golang.org/x/mod/module.EscapePath); module paths
+// passed to this package must not be encoded that way.
+func unescapeModulePath(modulePath string) (string, error) {
+	if !strings.Contains(modulePath, "%") {
+		return modulePath, nil
 	}
-	repo, relativeModulePath, templates, err := matchStatic(modulePath)
+	p, err := url.PathUnescape(modulePath)
 	if err != nil {
-		info, err = moduleInfoDynamic(ctx, client, modulePath, version)
+		return "", fmt.Errorf("%v: %w", err, derrors.InvalidArgument)
+	}
+	return p, nil
+}
+
+// unescapeVersion undoes the encodings that a version taken from a module proxy
+// URL may have: percent-encoding, as of the "+" of build metadata, and the "!"
+// encoding of upper-case letters, as in "v1.0.0-!r!c1" for "v1.0.0-RC1" (see
+// golang.org/x/mod/module.EscapeVersion). Unlike module paths, versions may be
+// passed to this package in either form, since a "!" cannot appear in a valid
+// version.
+func unescapeVersion(v string) (string, error) {
+	if strings.Contains(v, "%") {
+		u, err := url.PathUnescape(v)
 		if err != nil {
-			return nil, err
+			return "", fmt.Errorf("%v: %w", err, derrors.InvalidArgument)
 		}
-	} else {
-		info = &Info{
-			repoURL:   "https://" + repo,
-			moduleDir: relativeModulePath,
-			commit:    commitFromVersion(version, relativeModulePath),
-			templates: templates,
+		v = u
+	}
+	if strings.Contains(v, "!") {
+		u, err := module.UnescapeVersion(v)
+		if err != nil {
+			return "", fmt.Errorf("%v: %w", err, derrors.InvalidArgument)
 		}
+		v = u
 	}
-	adjustVersionedModuleDirectory(ctx, client, info)
-	return info, nil
-	// TODO(b/141770842): support launchpad.net, including the special case in cmd/go/internal/get/vcs.go.
+	return v, nil
 }
 
 // matchStatic matches the given module or repo path against a list of known
@@ -296,18 +1470,10 @@ func ModuleInfo(ctx context.Context, client *Client, modulePath, version string)
 // then repo="example.com/a/b" and relativeModulePath="c"; the ".git" is omitted, since it is neither
 // part of the repo nor part of the relative path to the module within the repo.
 func matchStatic(moduleOrRepoPath string) (repo, relativeModulePath string, _ urlTemplates, _ error) {
-	for _, pat := range patterns {
-		matches := pat.re.FindStringSubmatch(moduleOrRepoPath)
-		if matches == nil {
-			continue
-		}
-		var repo string
-		for i, n := range pat.re.SubexpNames() {
-			if n == "repo" {
-				repo = matches[i]
-				break
-			}
-		}
+	if k, loc := findPattern(moduleOrRepoPath); loc != nil {
+		pat := patterns[k]
+		rest := moduleOrRepoPath[loc[1]:]
+		repo = matchGroup(pat.re, moduleOrRepoPath, loc, "repo")
 		// Special case: git.apache.org has a go-import tag that points to
 		// github.com/apache, but it's not quite right (the repo prefix is
 		// missing a ".git"), so handle it here.
@@ -315,21 +1481,194 @@ func matchStatic(moduleOrRepoPath string) (repo, relativeModulePath string, _ ur
 		if strings.HasPrefix(repo, apacheDomain) {
 			repo = strings.Replace(repo, apacheDomain, "github.com/apache/", 1)
 		}
-		relativeModulePath = strings.TrimPrefix(moduleOrRepoPath, matches[0])
-		relativeModulePath = strings.TrimPrefix(relativeModulePath, "/")
+		relativeModulePath = strings.TrimPrefix(rest, "/")
 		return repo, relativeModulePath, pat.templates, nil
 	}
 	return "", "", urlTemplates{}, derrors.NotFound
 }
 
+// findPattern returns the index of the first of patterns that matches
+// moduleOrRepoPath, and the locations of the match and its groups, as from
+// regexp.Regexp.FindStringSubmatchIndex. If there is no match, the locations
+// are nil.
+func findPattern(moduleOrRepoPath string) (int, []int) {
+	for k, pat := range patterns {
+		if loc := matchPattern(pat.re, moduleOrRepoPath); loc != nil {
+			return k, loc
+		}
+	}
+	return -1, nil
+}
+
+// matchPattern returns the locations of a match of re in moduleOrRepoPath and
+// its groups, or nil if there is none.
+func matchPattern(re *regexp.Regexp, moduleOrRepoPath string) []int {
+	loc := re.FindStringSubmatchIndex(moduleOrRepoPath)
+	// The match must be a prefix of the path that ends at a path
+	// element boundary. Otherwise what follows the match would not be a
+	// relative path.
+	if loc == nil || loc[0] != 0 {
+		return nil
+	}
+	rest := moduleOrRepoPath[loc[1]:]
+	if rest != "" && rest[0] != '/' {
+		return nil
+	}
+	return loc
+}
+
+// A MatchDebug describes a match of a module path by one of the patterns used
+// to determine its repo without fetching meta tags.
+type MatchDebug struct {
+	Pattern      string // regular expression
+	Repo         string // repo, like "github.com/a/b"
+	RelativePath string // module path relative to the repo root
+	// Kind names the URL templates of the pattern, like "github". It is
+	// "custom" for templates without a name, and empty if the pattern has no
+	// templates.
+	Kind string
+}
+
+// CandidateMatches returns the matches of modulePath by all of the patterns,
+// in the order they are tried, for debugging. The first, if any, is the one
+// that ModuleInfo uses. It does not apply rewrites of modulePath.
+func CandidateMatches(modulePath string) []MatchDebug {
+	var ms []MatchDebug
+	for _, pat := range patterns {
+		loc := matchPattern(pat.re, modulePath)
+		if loc == nil {
+			continue
+		}
+		m := MatchDebug{
+			Pattern:      pat.re.String(),
+			Repo:         matchGroup(pat.re, modulePath, loc, "repo"),
+			RelativePath: strings.TrimPrefix(modulePath[loc[1]:], "/"),
+		}
+		if pat.templates != (urlTemplates{}) {
+			m.Kind = "custom"
+			for kind, t := range urlTemplatesByKind {
+				if t == pat.templates {
+					m.Kind = kind
+					break
+				}
+			}
+		}
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+// matchGroup returns the text of the group of re with the given name, in a
+// match of s with locations loc. It returns the empty string if the group
+// doesn't exist or didn't match.
+func matchGroup(re *regexp.Regexp, s string, loc []int, name string) string {
+	for i, n := range re.SubexpNames() {
+		if n == name && loc[2*i] >= 0 {
+			return s[loc[2*i]:loc[2*i+1]]
+		}
+	}
+	return ""
+}
+
+// repoOwnerAndName returns the owner and name of the repo at repoURL, if it
+// matches a pattern with groups for them.
+func repoOwnerAndName(repoURL string) (owner, name string) {
+	p := removeHTTPScheme(repoURL)
+	k, loc := findPattern(p)
+	if loc == nil {
+		return "", ""
+	}
+	re := patterns[k].re
+	return matchGroup(re, p, loc, "owner"), matchGroup(re, p, loc, "name")
+}
+
 // moduleInfoDynamic uses the go-import and go-source meta tags to construct an Info.
 func moduleInfoDynamic(ctx context.Context, client *Client, modulePath, version string) (_ *Info, err error) {
 	defer derrors.Wrap(&err, "source.moduleInfoDynamic(ctx, client, %q, %q)", modulePath, version)
 
-	sourceMeta, err := fetchMeta(ctx, client, modulePath)
-	if err != nil {
+	// Only make requests for valid module paths. Some paths cannot be
+	// resolved at all, like those beginning with an SSH host alias
+	// ("myhost:repo"), and others could produce malformed URLs.
+	if err := module.CheckPath(modulePath); err != nil {
+		return nil, fmt.Errorf("%v: %w", err, ErrNoSourceInfo)
+	}
+	if client == nil {
+		return nil, fmt.Errorf("no client to fetch meta tags: %w", ErrNoSourceInfo)
+	}
+	host := strings.SplitN(modulePath, "/", 2)[0]
+	if !client.allowsHost(host) {
+		return nil, fmt.Errorf("host %q not allowed: %w", host, ErrNoSourceInfo)
+	}
+	var sourceMeta *SourceMeta
+	if client.opts.RepoHint != nil {
+		sourceMeta, err = client.opts.RepoHint(ctx, modulePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sourceMeta != nil {
+		traceFrom(ctx).add("hint", "repo root %q, repo URL %q", sourceMeta.RepoRootPrefix, sourceMeta.RepoURL)
+		if err := checkRepoRootPrefix(sourceMeta, modulePath); err != nil {
+			return nil, err
+		}
+		// infoFromMeta modifies its argument, which belongs to the caller.
+		m := *sourceMeta
+		sourceMeta = &m
+	} else {
+		sourceMeta, err = client.fetchMeta(ctx, modulePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	info := infoFromMeta(ctx, sourceMeta, modulePath, version)
+	if !client.opts.Insecure && strings.HasPrefix(info.repoURL, "http://") {
+		info.repoURL = "https://" + strings.TrimPrefix(info.repoURL, "http://")
+	}
+	return info, nil
+}
+
+// ModuleInfoFromMeta is like ModuleInfo for a module whose path does not match
+// a known pattern, but uses the given meta tag information instead of fetching
+// it, as FetchMeta does. It makes no network requests, so it does not correct
+// the module's directory for repos that use the "major branch" convention.
+// Options set on ctx with WithOptions, like DefaultRef, apply.
+func ModuleInfoFromMeta(ctx context.Context, meta *SourceMeta, modulePath, version string) (_ *Info, err error) {
+	defer derrors.Wrap(&err, "source.ModuleInfoFromMeta(ctx, meta, %q, %q)", modulePath, version)
+
+	if meta == nil {
+		return nil, fmt.Errorf("nil meta: %w", derrors.InvalidArgument)
+	}
+	if err := checkRepoRootPrefix(meta, modulePath); err != nil {
 		return nil, err
 	}
+	var client *Client
+	if opts, ok := ctx.Value(optionsKey{}).(Options); ok {
+		client = client.withOptions(opts)
+	}
+	m := *meta
+	info := infoFromMeta(ctx, &m, modulePath, version)
+	if info.commit == "" {
+		info.commit = client.defaultRef(info.templates)
+		info.refKind = branchRef
+	}
+	info.forgetGuessableRefKind()
+	return info, nil
+}
+
+// checkRepoRootPrefix returns an error wrapping derrors.InvalidArgument if the
+// repo root prefix of meta is not a prefix of modulePath.
+func checkRepoRootPrefix(meta *SourceMeta, modulePath string) error {
+	if modulePath != meta.RepoRootPrefix && !strings.HasPrefix(modulePath, meta.RepoRootPrefix+"/") {
+		return fmt.Errorf("repo root prefix %q does not match: %w", meta.RepoRootPrefix, derrors.InvalidArgument)
+	}
+	return nil
+}
+
+// infoFromMeta returns an Info for the module from the information in its meta
+// tags. It modifies sourceMeta.
+func infoFromMeta(ctx context.Context, sourceMeta *SourceMeta, modulePath, version string) *Info {
+	sourceMeta.DirTemplate = absoluteTemplate(sourceMeta.RepoURL, legacyTemplate(sourceMeta.DirTemplate))
+	sourceMeta.FileTemplate = absoluteTemplate(sourceMeta.RepoURL, legacyTemplate(sourceMeta.FileTemplate))
 	// Don't check that the tag information at the repo root prefix is the same
 	// as in the module path. It was done for us by the proxy and/or go command.
 	// (This lets us merge information from the go-import and go-source tags.)
@@ -354,26 +1693,39 @@ func moduleInfoDynamic(ctx context.Context, client *Client, modulePath, version
 	//    existing go-source template. For example, by replacing "master" with "{commit}".
 	// We could also consider using the repo in the go-import tag instead of the one in the go-source tag,
 	// if the former matches a known pattern but the latter does not.
-	repoURL := sourceMeta.repoURL
+	// Hosts accept repo URLs with or without a ".git" suffix, but the URL
+	// templates expect the repo name without one.
+	repoURL := strings.TrimSuffix(strings.TrimSuffix(sourceMeta.RepoURL, "/"), ".git")
 	_, _, templates, _ := matchStatic(removeHTTPScheme(repoURL))
 	// If err != nil, templates will the zero value, so we can ignore it (same just below).
 	if templates == (urlTemplates{}) {
 		var repo string
-		repo, _, templates, _ = matchStatic(removeHTTPScheme(sourceMeta.dirTemplate))
-		if templates == (urlTemplates{}) {
-			log.Infof(ctx, "no templates for repo URL %q from meta tag: err=%v", sourceMeta.repoURL, err)
-		} else {
+		if repo, templates = matchCloneURL(repoURL); templates != (urlTemplates{}) {
+			// The repo URL is for cloning with another protocol, like
+			// "ssh://git@github.com/a/b". Link to the repo's web pages instead.
+			repoURL = "https://" + repo
+		} else if repo, _, templates, _ = matchStatic(removeHTTPScheme(sourceMeta.DirTemplate)); templates != (urlTemplates{}) {
 			// Use the repo from the template, not the original one.
 			repoURL = "https://" + repo
+		} else if hgRepoURL, hgTemplates, ok := hgwebTemplates(sourceMeta); ok {
+			repoURL = hgRepoURL
+			templates = hgTemplates
+		} else if gitRepoURL, gitTemplates, ok := gitServerTemplates(sourceMeta); ok {
+			repoURL = gitRepoURL
+			templates = gitTemplates
+		} else {
+			log.Infof(ctx, "no templates for repo URL %q from meta tag", sourceMeta.RepoURL)
 		}
 	}
-	dir := strings.TrimPrefix(strings.TrimPrefix(modulePath, sourceMeta.repoRootPrefix), "/")
+	traceTemplates(ctx, templates)
+	dir := strings.TrimPrefix(strings.TrimPrefix(modulePath, sourceMeta.RepoRootPrefix), "/")
 	return &Info{
 		repoURL:   strings.TrimSuffix(repoURL, "/"),
 		moduleDir: dir,
 		commit:    commitFromVersion(version, dir),
+		refKind:   versionRefKind(version),
 		templates: templates,
-	}, nil
+	}
 }
 
 // adjustVersionedModuleDirectory changes info.moduleDir if necessary to
@@ -399,6 +1751,170 @@ func adjustVersionedModuleDirectory(ctx context.Context, client *Client, info *I
 	}
 }
 
+// checkTagPrefix replaces info.commit with the same tag without its leading
+// "v", if vers is not a pseudo-version, info.commit is a tag that doesn't
+// exist, and the tag without the "v" does. Tags are checked by requesting the
+// module's directory at them.
+func (c *Client) checkTagPrefix(ctx context.Context, info *Info, vers string) {
+	v := strings.TrimSuffix(vers, "+incompatible")
+	if version.IsPseudo(v) || !semver.IsValid(v) || info.ModuleURL() == "" {
+		return
+	}
+	exists := func(i *Info) bool {
+		res, err := c.doURL(ctx, "HEAD", i.ModuleURL(), true)
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		return true
+	}
+	if exists(info) {
+		return
+	}
+	// The tag of a nested module is prefixed by its directory.
+	k := strings.LastIndex(info.commit, "/") + 1
+	if !strings.HasPrefix(info.commit[k:], "v") {
+		return
+	}
+	i := *info
+	i.commit = info.commit[:k] + info.commit[k+1:]
+	if exists(&i) {
+		log.Infof(ctx, "using tag %q for %q", i.commit, info.commit)
+		info.commit = i.commit
+	}
+}
+
+// resolveTag replaces info.commit with the ID of the commit it refers to, if
+// vers is not a pseudo-version (so info.commit is a tag). If the tag cannot be
+// resolved, info is unchanged.
+func (c *Client) resolveTag(ctx context.Context, info *Info, vers string) {
+	if version.IsPseudo(strings.TrimSuffix(vers, "+incompatible")) {
+		return
+	}
+	commit, err := c.commitResolver().ResolveTag(ctx, info, info.commit)
+	if err != nil {
+		log.Infof(ctx, "using tag %q: %v", info.commit, err)
+		return
+	}
+	info.commit = commit
+	info.refKind = commitRef
+}
+
+// shortCommitLength is the length to which full commit IDs are shortened.
+// Hosts display fewer digits, but twelve stay unique even in large repos.
+const shortCommitLength = 12
+
+// shortCommitHosts holds the templates of the hosts that accept abbreviated
+// commit IDs in URLs.
+var shortCommitHosts = map[urlTemplates]bool{
+	githubURLTemplates:    true,
+	gitlabURLTemplates:    true,
+	bitbucketURLTemplates: true,
+	giteaURLTemplates:     true,
+	gogsURLTemplates:      true,
+	sourcehutURLTemplates: true,
+}
+
+// fullCommitRegexp matches a full SHA-1 or SHA-256 git commit ID.
+var fullCommitRegexp = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+// shortenCommit returns commit shortened to shortCommitLength, if commit is a
+// full commit ID and the host of templates accepts abbreviated ones.
+// Otherwise it returns commit.
+func shortenCommit(commit string, templates urlTemplates) string {
+	if !shortCommitHosts[templates] || !fullCommitRegexp.MatchString(commit) {
+		return commit
+	}
+	return commit[:shortCommitLength]
+}
+
+// followRepoRedirect replaces info.repoURL with the URL that a GitHub repo
+// URL redirects to, if it redirects to another repo on the same host. If it
+// does not, or the request fails, info is unchanged.
+func (c *Client) followRepoRedirect(ctx context.Context, info *Info) {
+	if info.templates != githubURLTemplates || c.httpClient == nil {
+		return
+	}
+	req, err := http.NewRequest("HEAD", info.repoURL, nil)
+	if err != nil {
+		return
+	}
+	resp, err := c.do(ctx, req, false)
+	if err != nil {
+		log.Infof(ctx, "following redirect of %q: %v", info.repoURL, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently && resp.StatusCode != http.StatusFound {
+		return
+	}
+	loc, err := resp.Location()
+	if err != nil {
+		return
+	}
+	old, err := url.Parse(info.repoURL)
+	if err != nil || loc.Host != old.Host {
+		return
+	}
+	// Keep only the owner and repo name.
+	parts := strings.SplitN(strings.Trim(loc.Path, "/"), "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return
+	}
+	info.repoURL = fmt.Sprintf("%s://%s/%s/%s", old.Scheme, old.Host, parts[0], parts[1])
+}
+
+// rebaseURL replaces the scheme and host of rawurl with base.
+func rebaseURL(rawurl, base string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	return strings.TrimSuffix(base, "/") + u.EscapedPath()
+}
+
+// browseURL replaces the host of rawurl with the one it maps to in hosts, if
+// any.
+func browseURL(rawurl string, hosts map[string]string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	h, ok := hosts[u.Host]
+	if !ok {
+		return rawurl
+	}
+	u.Host = h
+	return u.String()
+}
+
+// lowercaseHost returns modulePath with its first element, the host, in lower
+// case. Host names are case-insensitive, but our patterns expect lower case.
+// The rest of the path is case-sensitive, and is unchanged.
+func lowercaseHost(modulePath string) string {
+	i := strings.IndexByte(modulePath, '/')
+	if i < 0 {
+		return strings.ToLower(modulePath)
+	}
+	return strings.ToLower(modulePath[:i]) + modulePath[i:]
+}
+
+// matchCloneURL matches the host and path of a repo URL with a scheme other
+// than http or https, like "git://github.com/a/b", against our static
+// patterns. It returns the repo and its templates if there is a match, and the
+// zero templates otherwise.
+func matchCloneURL(repoURL string) (string, urlTemplates) {
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Scheme == "http" || u.Scheme == "https" || u.Host == "" {
+		return "", urlTemplates{}
+	}
+	repo, _, templates, err := matchStatic(u.Hostname() + strings.TrimSuffix(u.Path, ".git"))
+	if err != nil {
+		return "", urlTemplates{}
+	}
+	return repo, templates
+}
+
 // removeHTTPScheme removes an initial "http://" or "https://" from url.
 // The result can be used to match against our static patterns.
 // If the URL uses a different scheme, it won't be removed and it won't
@@ -434,11 +1950,11 @@ var patterns = []struct {
 }{
 	// Patterns known to the go command.
 	{
-		regexp.MustCompile(`^(?P<repo>github\.com/[a-z0-9A-Z_.\-]+/[a-z0-9A-Z_.\-]+)`),
+		regexp.MustCompile(`^(?P<repo>github\.com/(?P<owner>[a-z0-9A-Z_.\-]+)/(?P<name>[a-z0-9A-Z_.\-]+))`),
 		githubURLTemplates,
 	},
 	{
-		regexp.MustCompile(`^(?P<repo>bitbucket\.org/[a-z0-9A-Z_.\-]+/[a-z0-9A-Z_.\-]+)`),
+		regexp.MustCompile(`^(?P<repo>bitbucket\.org/(?P<owner>[a-z0-9A-Z_.\-]+)/(?P<name>[a-z0-9A-Z_.\-]+))`),
 		bitbucketURLTemplates,
 	},
 	// Other patterns from cmd/go/internal/get/vcs.go, that we omit:
@@ -461,18 +1977,20 @@ var patterns = []struct {
 		regexp.MustCompile(`^(?P<repo>gitee\.com/[a-z0-9A-Z_.\-]+/[a-z0-9A-Z_.\-]+)(\.git|$)`),
 		gitlabURLTemplates,
 	},
+	{
+		regexp.MustCompile(`^(?P<repo>git\.sr\.ht/~(?P<owner>[a-z0-9A-Z_.\-]+)/(?P<name>[a-z0-9A-Z_.\-]+))`),
+		sourcehutURLTemplates,
+	},
 
 	// Patterns that match the general go command pattern, where they must have
 	// a ".git" repo suffix in an import path. If matching a repo URL from a meta tag,
 	// there is no ".git".
 	{
-		regexp.MustCompile(`^(?P<repo>[^.]+\.googlesource\.com/[^.]+)(\.git|$)`),
-		urlTemplates{
-			Directory: "{repo}/+/{commit}/{dir}",
-			File:      "{repo}/+/{commit}/{file}",
-			Line:      "{repo}/+/{commit}/{file}#{line}",
-			// no raw support (b/13912564)
-		},
+		// Googlesource repo paths may have any number of elements, which may
+		// contain dots, as in "chromium.googlesource.com/external/github.com/a/b".
+		// The repo ends at a ".git", or at the end of the path.
+		regexp.MustCompile(`^(?P<repo>[a-z0-9\-]+\.googlesource\.com/[A-Za-z0-9_.\-/]+?)(\.git|$)`),
+		gitilesURLTemplates,
 	},
 	{
 		regexp.MustCompile(`^(?P<repo>git\.apache\.org/[^.]+)(\.git|$)`),
@@ -482,11 +2000,61 @@ var patterns = []struct {
 	// we don't know the URL templates.
 	// Must be last in this list.
 	{
-		regexp.MustCompile(`(?P<repo>([a-z0-9.\-]+\.)+[a-z0-9.\-]+(:[0-9]+)?(/~?[A-Za-z0-9_.\-]+)+?)\.(bzr|fossil|git|hg|svn)`),
+		regexp.MustCompile(`^(?P<repo>([a-z0-9.\-]+\.)+[a-z0-9.\-]+(:[0-9]+)?(/~?[A-Za-z0-9_.\-]+)+?)\.(bzr|fossil|git|hg|svn)`),
 		urlTemplates{},
 	},
 }
 
+// AddGiteaHost causes module paths and repo URLs beginning with hostname to
+// be treated as repos on a Gitea server, whose paths are like those of GitHub
+// repos: hostname/owner/repo. Since repo URLs from meta tags match too, so do
+// modules with vanity paths whose go-import tags refer to the server.
+//
+// AddGiteaHost and AddGogsHost must be called before any source information is
+// resolved, for example from an init function; they are not safe to call
+// concurrently with other functions of this package.
+func AddGiteaHost(hostname string) {
+	addHost(hostname, giteaURLTemplates)
+}
+
+// AddGogsHost is like AddGiteaHost, for a Gogs server.
+func AddGogsHost(hostname string) {
+	addHost(hostname, gogsURLTemplates)
+}
+
+// AddPhabricatorRepo causes the repo with the given callsign on a Phabricator
+// server at host to be browsed with Diffusion, Phabricator's repo browser. The
+// repo's URL is like "https://host/source/callsign", which is typically what
+// the go-import meta tags of its modules refer to. Like AddGiteaHost, it must
+// be called before any source information is resolved.
+func AddPhabricatorRepo(host, callsign string) {
+	addPattern(regexp.MustCompile(`^(?P<repo>`+regexp.QuoteMeta(host+"/source/"+callsign)+`)`), phabricatorURLTemplates)
+}
+
+// AddCgitHost causes module paths and repo URLs beginning with hostname to be
+// treated as repos on a cgit server, like git.kernel.org. As for googlesource.com
+// repos, the repo path may have any number of elements, and ends at a ".git"
+// or at the end of the module path. Like AddGiteaHost, it must be called
+// before any source information is resolved.
+func AddCgitHost(hostname string) {
+	addPattern(regexp.MustCompile(`^(?P<repo>`+regexp.QuoteMeta(hostname)+`/[A-Za-z0-9_.\-/]+?)(\.git|$)`), cgitURLTemplates)
+}
+
+// addHost adds a pattern for repos on hostname with the given templates.
+func addHost(hostname string, templates urlTemplates) {
+	addPattern(regexp.MustCompile(`^(?P<repo>`+regexp.QuoteMeta(hostname)+`/(?P<owner>[a-z0-9A-Z_.\-]+)/(?P<name>[a-z0-9A-Z_.\-]+))`), templates)
+}
+
+// addPattern adds a pattern with the given templates before the general syntax
+// for the go command, which must remain last.
+func addPattern(re *regexp.Regexp, templates urlTemplates) {
+	last := len(patterns) - 1
+	// Copy, so that the slice of patterns in use is not modified.
+	patterns = append(patterns[:last:last], patterns[last], patterns[last])
+	patterns[last].re = re
+	patterns[last].templates = templates
+}
+
 func init() {
 	for _, p := range patterns {
 		found := false
@@ -499,16 +2067,52 @@ func init() {
 		if !found {
 			panic(fmt.Sprintf("pattern %s missing <repo> group", p.re))
 		}
+		if !anchored(p.re) {
+			panic(fmt.Sprintf("pattern %s not anchored with ^", p.re))
+		}
+	}
+}
+
+// anchored reports whether re can match only at the start of the text. A
+// pattern that could match in the middle of a path would yield a repo that is
+// not a prefix of it.
+func anchored(re *regexp.Regexp) bool {
+	s, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return false
 	}
+	for (s.Op == syntax.OpConcat || s.Op == syntax.OpCapture) && len(s.Sub) > 0 {
+		s = s.Sub[0]
+	}
+	return s.Op == syntax.OpBeginText
 }
 
 // urlTemplates describes how to build URLs from bits of source information.
-// The fields are exported for JSON encoding.
+// The fields are exported for JSON encoding. Besides the variables listed for
+// each, a template may use {owner} and {name}, which are the parts of the repo
+// matched by groups of those names in its pattern, like "golang" and "go" for
+// the GitHub repo "github.com/golang/go".
 type urlTemplates struct {
 	Directory string // URL template for a directory, with {repo}, {commit} and {dir}
 	File      string // URL template for a file, with {repo}, {commit} and {file}
 	Line      string // URL template for a line, with {repo}, {commit}, {file} and {line}
 	Raw       string // URL template for the raw contents of a file, with {repo}, {repoPath}, {commit} and {file}
+	Issues    string `json:",omitempty"` // URL template for the repo's issue tracker, with {repo}
+	Compare   string `json:",omitempty"` // URL template for a diff between two commits, with {repo}, {commit} and {otherCommit}
+	Release   string `json:",omitempty"` // URL template for the release notes of a tag, with {repo} and {tag}
+	LineRange string `json:",omitempty"` // URL template for a range of lines, with {repo}, {commit}, {file}, {start} and {end}
+	// URL template for the raw contents of a file and a range of lines in it,
+	// with the variables of Raw and LineRange.
+	RawLineRange string `json:",omitempty"`
+	Wiki         string `json:",omitempty"` // URL template for the repo's wiki, with {repo}
+	ReleasesFeed string `json:",omitempty"` // URL template for a feed of the repo's releases, with {repo}
+	TagsFeed     string `json:",omitempty"` // URL template for a feed of the repo's tags, with {repo}
+	Actions      string `json:",omitempty"` // URL template for the repo's CI workflow runs, with {repo}
+	Log          string `json:",omitempty"` // URL template for the history of the repo, with {repo} and {commit}
+	DirectoryLog string `json:",omitempty"` // URL template for the history of a directory, with {repo}, {commit} and {dir}
+	// Query parameter that makes the host show the source of a file that it
+	// would otherwise render, like a Markdown file; not a template.
+	SourceView string `json:",omitempty"`
 }
 
 var (
@@ -517,6 +2121,17 @@ var (
 		File:      "{repo}/blob/{commit}/{file}",
 		Line:      "{repo}/blob/{commit}/{file}#L{line}",
 		Raw:       "https://raw.githubusercontent.com/{repoPath}/{commit}/{file}",
+		Issues:    "{repo}/issues",
+		Compare:   "{repo}/compare/{otherCommit}...{commit}",
+		Release:   "{repo}/releases/tag/{tag}",
+		LineRange: "{repo}/blob/{commit}/{file}#L{start}-L{end}",
+		Wiki:      "{repo}/wiki",
+
+		RawLineRange: "https://raw.githubusercontent.com/{repoPath}/{commit}/{file}#L{start}-L{end}",
+		ReleasesFeed: "{repo}/releases.atom",
+		TagsFeed:     "{repo}/tags.atom",
+		Actions:      "{repo}/actions",
+		SourceView:   "plain=1",
 	}
 
 	gitlabURLTemplates = urlTemplates{
@@ -524,6 +2139,13 @@ var (
 		File:      "{repo}/blob/{commit}/{file}",
 		Line:      "{repo}/blob/{commit}/{file}#L{line}",
 		Raw:       "{repo}/raw/{commit}/{file}",
+		Issues:    "{repo}/-/issues",
+		Compare:   "{repo}/-/compare/{otherCommit}...{commit}",
+		Release:   "{repo}/-/releases/{tag}",
+		LineRange: "{repo}/blob/{commit}/{file}#L{start}-{end}",
+		Wiki:      "{repo}/-/wikis/home",
+
+		SourceView: "plain=1",
 	}
 
 	bitbucketURLTemplates = urlTemplates{
@@ -531,18 +2153,119 @@ var (
 		File:      "{repo}/src/{commit}/{file}",
 		Line:      "{repo}/src/{commit}/{file}#lines-{line}",
 		Raw:       "{repo}/raw/{commit}/{file}",
+		Issues:    "{repo}/issues",
+		Compare:   "{repo}/branches/compare/{commit}%0D{otherCommit}",
+		LineRange: "{repo}/src/{commit}/{file}#lines-{start}:{end}",
+		Wiki:      "{repo}/wiki",
+	}
+
+	// Gitea's URLs say what kind of ref they have; "commit" works for tags
+	// as well as commit IDs.
+	giteaURLTemplates = urlTemplates{
+		Directory: "{repo}/src/commit/{commit}/{dir}",
+		File:      "{repo}/src/commit/{commit}/{file}",
+		Line:      "{repo}/src/commit/{commit}/{file}#L{line}",
+		Raw:       "{repo}/raw/commit/{commit}/{file}",
+		Issues:    "{repo}/issues",
+		Compare:   "{repo}/compare/{otherCommit}...{commit}",
+		Release:   "{repo}/releases/tag/{tag}",
+		LineRange: "{repo}/src/commit/{commit}/{file}#L{start}-L{end}",
+		Wiki:      "{repo}/wiki",
+	}
+
+	// SourceHut browses files under "tree", and serves them raw under "blob".
+	sourcehutURLTemplates = urlTemplates{
+		Directory: "{repo}/tree/{commit}/item/{dir}",
+		File:      "{repo}/tree/{commit}/item/{file}",
+		Line:      "{repo}/tree/{commit}/item/{file}#L{line}",
+		Raw:       "{repo}/blob/{commit}/{file}",
+		Release:   "{repo}/refs/{tag}",
+
+		Log:          "{repo}/log/{commit}",
+		DirectoryLog: "{repo}/log/{commit}/item/{dir}",
+	}
+
+	// Diffusion, the repo browser of Phabricator, accepts any ref in place
+	// of a branch, and separates the line number from the file with a "$".
+	phabricatorURLTemplates = urlTemplates{
+		Directory: "{repo}/browse/{commit}/{dir}",
+		File:      "{repo}/browse/{commit}/{file}",
+		Line:      "{repo}/browse/{commit}/{file}${line}",
+		Raw:       "{repo}/browse/{commit}/{file}?view=raw",
+		LineRange: "{repo}/browse/{commit}/{file}${start}-{end}",
+	}
+
+	// Gitiles serves googlesource.com repos, among others.
+	gitilesURLTemplates = urlTemplates{
+		Directory: "{repo}/+/{commit}/{dir}",
+		File:      "{repo}/+/{commit}/{file}",
+		Line:      "{repo}/+/{commit}/{file}#{line}",
+		// no raw support (b/13912564)
+
+		Log:          "{repo}/+log/{commit}",
+		DirectoryLog: "{repo}/+log/{commit}/{dir}",
+	}
+
+	// cgit takes the ref in a query parameter, and its line anchors are like "#n10".
+	cgitURLTemplates = urlTemplates{
+		Directory: "{repo}/tree/{dir}?h={commit}",
+		File:      "{repo}/tree/{file}?h={commit}",
+		Line:      "{repo}/tree/{file}?h={commit}#n{line}",
+		Raw:       "{repo}/plain/{file}?h={commit}",
+	}
+
+	// Gogs, from which Gitea was forked, has no ref kind in its URLs.
+	gogsURLTemplates = urlTemplates{
+		Directory: "{repo}/src/{commit}/{dir}",
+		File:      "{repo}/src/{commit}/{file}",
+		Line:      "{repo}/src/{commit}/{file}#L{line}",
+		Raw:       "{repo}/raw/{commit}/{file}",
+		Issues:    "{repo}/issues",
+		Compare:   "{repo}/compare/{otherCommit}...{commit}",
+		LineRange: "{repo}/src/{commit}/{file}#L{start}-L{end}",
+		Wiki:      "{repo}/wiki",
 	}
 )
 
+// gitURLTemplates are those of hosts that serve only git repos, which take
+// "HEAD" to mean the tip of the default branch.
+var gitURLTemplates = []urlTemplates{
+	githubURLTemplates,
+	gitlabURLTemplates,
+	bitbucketURLTemplates,
+	giteaURLTemplates,
+	gogsURLTemplates,
+	sourcehutURLTemplates,
+	gitilesURLTemplates,
+}
+
 // commitFromVersion returns a string that refers to a commit corresponding to version.
 // The string may be a tag, or it may be the hash or similar unique identifier of a commit.
 // The second argument is the module path relative to the repo root.
+//
+// The "+incompatible" suffix of a version is not part of its tag, including
+// that of a nested module, like "sub/v2.0.0" for "v2.0.0+incompatible". Nor
+// is other build metadata, like the "+build.5" of "v1.2.3+build.5".
+//
+// A version that is not a complete semantic version is taken to be a branch
+// name, like "master" or "v2", and used as is.
+//
+// Retracted versions need no special treatment: a retraction is recorded in
+// the go.mod file of a later version, and the tag for the retracted version
+// still exists.
 func commitFromVersion(vers, relativeModulePath string) string {
 	// Commit for the module: either a sha for pseudoversions, or a tag.
 	v := strings.TrimSuffix(vers, "+incompatible")
+	if semver.IsValid(v) {
+		v = strings.TrimSuffix(v, semver.Build(v))
+	}
 	if version.IsPseudo(v) {
 		// Use the commit hash at the end.
 		return v[strings.LastIndex(v, "-")+1:]
+	} else if !semver.IsValid(v) || semver.Canonical(v) != v {
+		// Not a module version, but presumably a branch name, like "main"
+		// or "v2", which is not prefixed by the module's directory.
+		return v
 	} else {
 		// The tags for a nested module begin with the relative module path of the module,
 		// removing a "/vN" suffix if N > 1.
@@ -554,6 +2277,118 @@ func commitFromVersion(vers, relativeModulePath string) string {
 	}
 }
 
+// versionRefKind returns the kind of the ref that commitFromVersion returns
+// for vers.
+func versionRefKind(vers string) refKind {
+	v := strings.TrimSuffix(vers, "+incompatible")
+	if semver.IsValid(v) {
+		v = strings.TrimSuffix(v, semver.Build(v))
+	}
+	switch {
+	case vers == "":
+		return unknownRef
+	case version.IsPseudo(v):
+		return commitRef
+	case semver.Canonical(v) == v:
+		return tagRef
+	default:
+		return branchRef
+	}
+}
+
+// pseudoVersionRegexp matches a pseudo-version. The groups are:
+// 1  the major and minor version of the base version, like "v1.2."
+// 2  the patch number plus one, if the base version is a release
+// 3  the patch number and prerelease, if the base version is a prerelease
+// 4  the build metadata, if any, including its leading "+"
+var pseudoVersionRegexp = regexp.MustCompile(`^(v[0-9]+\.[0-9]+\.)(?:([0-9]+)-0\.|([0-9]+-[^+]*)\.0\.|0-)[0-9]{14}-[A-Za-z0-9]+(\+.*)?$`)
+
+// PseudoVersionBase returns the version that the pseudo-version v is based on,
+// which is the latest tagged version that precedes v's commit. It returns the
+// empty string if there is no such version, as for "v0.0.0-20200101000000-abcdef123456".
+// There are three forms of pseudo-version:
+//   vX.0.0-yyyymmddhhmmss-abcdefabcdef      has no base version
+//   vX.Y.(Z+1)-0.yyyymmddhhmmss-abcdefabcdef is based on vX.Y.Z
+//   vX.Y.Z-pre.0.yyyymmddhhmmss-abcdefabcdef is based on vX.Y.Z-pre
+// Note that a pseudo-version does not record the branch of its commit.
+func PseudoVersionBase(v string) (_ string, err error) {
+	defer derrors.Wrap(&err, "PseudoVersionBase(%q)", v)
+
+	m := pseudoVersionRegexp.FindStringSubmatch(v)
+	if m == nil || !version.IsPseudo(v) {
+		return "", fmt.Errorf("not a pseudo-version: %w", derrors.InvalidArgument)
+	}
+	prefix, patch, pre, build := m[1], m[2], m[3], m[4]
+	switch {
+	case pre != "":
+		return prefix + pre + build, nil
+	case patch != "":
+		n, err := strconv.Atoi(patch)
+		if err != nil || n == 0 {
+			return "", fmt.Errorf("bad patch number: %w", derrors.InvalidArgument)
+		}
+		return prefix + strconv.Itoa(n-1) + build, nil
+	default:
+		return "", nil
+	}
+}
+
+// expand expands templ with vars. If templ refers to them, it also provides
+// {owner} and {name}, the owner and name of i's repo. They come from the groups
+// of the repo's pattern, or for patterns without them, from the repo URL's
+// path, whose last element is the name and the rest the owner. If there are
+// no owner and name, as for a repo URL with a path of one element, expand
+// returns the empty string, since the URL would be broken.
+//
+// The values of {commit}, {dir} and {file} are paths, whose elements are
+// escaped so that they can appear in URLs.
+func (i *Info) expand(templ string, vars map[string]string) string {
+	if templ == noTemplate {
+		return ""
+	}
+	if strings.Contains(templ, "{owner}") || strings.Contains(templ, "{name}") {
+		owner, name := repoOwnerAndName(i.repoURL)
+		if owner == "" || name == "" {
+			owner, name = splitRepoPath(i.repoURL)
+		}
+		if owner == "" || name == "" {
+			return ""
+		}
+		vars["owner"], vars["name"] = owner, name
+	}
+	for _, k := range []string{"commit", "otherCommit", "dir", "file"} {
+		if v, ok := vars[k]; ok {
+			vars[k] = escapePath(v)
+		}
+	}
+	return expand(templ, vars)
+}
+
+// splitRepoPath returns the path of repoURL without its last element, and the
+// last element, if the path has at least two elements.
+func splitRepoPath(repoURL string) (owner, name string) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", ""
+	}
+	p := strings.Trim(u.Path, "/")
+	i := strings.LastIndexByte(p, '/')
+	if i <= 0 {
+		return "", ""
+	}
+	return p[:i], p[i+1:]
+}
+
+// escapePath escapes each element of the slash-separated path p, as for a URL
+// path.
+func escapePath(p string) string {
+	elems := strings.Split(p, "/")
+	for i, e := range elems {
+		elems[i] = url.PathEscape(e)
+	}
+	return strings.Join(elems, "/")
+}
+
 // The following code copied from cmd/go/internal/get:
 
 // expand rewrites s to replace {k} with match[k] for each key k in match.
@@ -568,6 +2403,40 @@ func expand(s string, match map[string]string) string {
 	return strings.NewReplacer(oldNew...).Replace(s)
 }
 
+// EmptyInfo returns an Info for a module whose source could not be resolved.
+// All of its URL methods return the empty string, so it can be used in place of
+// a nil Info by callers that want to render a page without source links.
+// repoURLGuess, which may be empty, is returned by RepoURL; it is only a best
+// guess at the module's repo, and may not exist.
+func EmptyInfo(repoURLGuess string) *Info {
+	return &Info{repoURL: repoURLGuess}
+}
+
+// LocalInfo returns an Info for a module in the directory moduleDir, an
+// absolute path on the local file system, as for a working tree served by a
+// locally running pkgsite. Its URLs are file:// URLs, which have no commit and
+// cannot refer to lines, so its line URLs are those of the files.
+func LocalInfo(moduleDir string) *Info {
+	p := filepath.ToSlash(moduleDir)
+	if !strings.HasPrefix(p, "/") {
+		// A Windows path, like "C:/src/mod".
+		p = "/" + p
+	}
+	u := url.URL{Scheme: "file", Path: strings.TrimSuffix(p, "/")}
+	return &Info{
+		repoURL:   u.String(),
+		templates: localURLTemplates,
+	}
+}
+
+// localURLTemplates are the templates of the Infos returned by LocalInfo.
+var localURLTemplates = urlTemplates{
+	Directory: "{repo}/{dir}",
+	File:      "{repo}/{file}",
+	Line:      "{repo}/{file}",
+	Raw:       "{repo}/{file}",
+}
+
 // NewGitHubInfo creates a source.Info with GitHub URL templates.
 // It is for testing only.
 func NewGitHubInfo(repoURL, moduleDir, commit string) *Info {
@@ -7,6 +7,7 @@ package source
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -19,6 +20,7 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-replayers/httpreplay"
+	"golang.org/x/pkgsite/internal/derrors"
 )
 
 var (
@@ -34,7 +36,11 @@ func TestModuleInfo(t *testing.T) {
 		if got != want {
 			t.Fatalf("%s:\ngot  %s\nwant %s", msg, got, want)
 		}
-		res, err := client.Head(got)
+		// The recording predates the query parameter of line URLs that
+		// shows the source of a rendered file, like a README, instead of
+		// rendering it. It is tested by TestRenderedFileLineURLs; request the
+		// file as recorded.
+		res, err := client.Head(strings.Replace(got, "?"+githubURLTemplates.SourceView, "", 1))
 		if err != nil {
 			t.Fatalf("%s: %v", got, err)
 		}
@@ -120,7 +126,7 @@ func TestModuleInfo(t *testing.T) {
 			"https://github.com/golang/tools",
 			"https://github.com/golang/tools/tree/030b2cf1153e",
 			"https://github.com/golang/tools/blob/030b2cf1153e/README.md",
-			"https://github.com/golang/tools/blob/030b2cf1153e/README.md#L1",
+			"https://github.com/golang/tools/blob/030b2cf1153e/README.md?plain=1#L1",
 			"https://raw.githubusercontent.com/golang/tools/030b2cf1153e/README.md",
 		},
 		{
@@ -265,7 +271,8 @@ func TestModuleInfo(t *testing.T) {
 		},
 	} {
 		t.Run(test.desc, func(t *testing.T) {
-			info, err := ModuleInfo(context.Background(), &Client{client}, test.modulePath, test.version)
+			// Some meta tags, like gonum.org's, were recorded over http.
+			info, err := ModuleInfo(context.Background(), &Client{httpClient: client, opts: Options{Insecure: true}}, test.modulePath, test.version)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -282,7 +289,7 @@ func TestModuleInfo(t *testing.T) {
 
 	t.Run("stdlib-raw", func(t *testing.T) {
 		// Test raw URLs from the standard library, which are a special case.
-		info, err := ModuleInfo(context.Background(), &Client{client}, "std", "v1.13.3")
+		info, err := ModuleInfo(context.Background(), &Client{httpClient: client}, "std", "v1.13.3")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -332,6 +339,8 @@ func TestMatchStatic(t *testing.T) {
 		{"foo.googlesource.com/a/b/c", "foo.googlesource.com/a/b/c", ""},
 		{"foo.googlesource.com/a/b/c.git", "foo.googlesource.com/a/b/c", ""},
 		{"foo.googlesource.com/a/b/c.git/d", "foo.googlesource.com/a/b/c", "d"},
+		{"foo.googlesource.com/a/b.c/d", "foo.googlesource.com/a/b.c/d", ""},
+		{"foo.googlesource.com/a/b.c/d.git/e/f", "foo.googlesource.com/a/b.c/d", "e/f"},
 		{"git.com/repo.git", "git.com/repo", ""},
 		{"git.com/repo.git/dir", "git.com/repo", "dir"},
 		{"mercurial.com/repo.hg", "mercurial.com/repo", ""},
@@ -349,14 +358,29 @@ func TestMatchStatic(t *testing.T) {
 	}
 }
 
+func TestMatchStaticNoMatch(t *testing.T) {
+	for _, in := range []string{
+		"github.com/a",
+		"x/git.com/repo.git",    // match must be at the start
+		"git.com/repo.gitx/dir", // match must end at a path element
+		"github.com/a/b~c",
+	} {
+		if repo, suffix, _, err := matchStatic(in); err == nil {
+			t.Errorf("%q: got %q, %q; want no match", in, repo, suffix)
+		}
+	}
+}
+
 // This test adapted from gddo/gosrc/gosrc_test.go:TestGetDynamic.
 func TestModuleImportDynamic(t *testing.T) {
 	// For this test, fake the HTTP requests so we can cover cases that may not appear in the wild.
+	// Some of them are only served over http.
 	client := &Client{
 		httpClient: &http.Client{
 			Transport: testTransport(testWeb),
 			Timeout:   testTimeout,
 		},
+		opts: Options{Insecure: true},
 	}
 	// The version doesn't figure into the interesting work and we test versions to commits
 	// elsewhere, so use the same version throughout.
@@ -371,6 +395,7 @@ func TestModuleImportDynamic(t *testing.T) {
 				repoURL:   "https://github.com/alice/pkg",
 				moduleDir: "",
 				commit:    "v1.2.3",
+				refKind:   tagRef,
 				templates: githubURLTemplates,
 			},
 		},
@@ -380,6 +405,7 @@ func TestModuleImportDynamic(t *testing.T) {
 				repoURL:   "https://github.com/alice/pkg",
 				moduleDir: "sub",
 				commit:    "sub/v1.2.3",
+				refKind:   tagRef,
 				templates: githubURLTemplates,
 			},
 		},
@@ -389,6 +415,7 @@ func TestModuleImportDynamic(t *testing.T) {
 				repoURL:   "https://github.com/alice/pkg",
 				moduleDir: "http",
 				commit:    "http/v1.2.3",
+				refKind:   tagRef,
 				templates: githubURLTemplates,
 			},
 		},
@@ -399,6 +426,7 @@ func TestModuleImportDynamic(t *testing.T) {
 				repoURL:   "http://alice.org/pkg",
 				moduleDir: "source",
 				commit:    "source/v1.2.3",
+				refKind:   tagRef,
 				// empty templates
 			},
 		},
@@ -410,6 +438,7 @@ func TestModuleImportDynamic(t *testing.T) {
 				repoURL:   "http://alice.org/pkg",
 				moduleDir: "ignore",
 				commit:    "ignore/v1.2.3",
+				refKind:   tagRef,
 				// empty templates
 			},
 		},
@@ -418,20 +447,22 @@ func TestModuleImportDynamic(t *testing.T) {
 		{
 			"bob.com/pkg",
 			&Info{
-				// The go-import tag's repo root ends in ".git", but according to the spec
-				// there should not be a .vcs suffix, so we include the ".git" in the repo URL.
-				repoURL:   "https://vcs.net/bob/pkg.git",
+				// The go-import tag's repo root ends in ".git", which is trimmed
+				// so that URLs built from the repo URL don't include it.
+				repoURL:   "https://vcs.net/bob/pkg",
 				moduleDir: "",
 				commit:    "v1.2.3",
+				refKind:   tagRef,
 				// empty templates
 			},
 		},
 		{
 			"bob.com/pkg/sub",
 			&Info{
-				repoURL:   "https://vcs.net/bob/pkg.git",
+				repoURL:   "https://vcs.net/bob/pkg",
 				moduleDir: "sub",
 				commit:    "sub/v1.2.3",
+				refKind:   tagRef,
 				// empty templates
 			},
 		},
@@ -443,6 +474,7 @@ func TestModuleImportDynamic(t *testing.T) {
 				repoURL:   "https://github.com/azul3d/examples",
 				moduleDir: "abs",
 				commit:    "abs/v1.2.3",
+				refKind:   tagRef,
 				templates: githubURLTemplates,
 			},
 		},
@@ -453,6 +485,7 @@ func TestModuleImportDynamic(t *testing.T) {
 				repoURL:   "https://github.com/myitcv/x",
 				moduleDir: "",
 				commit:    "v1.2.3",
+				refKind:   tagRef,
 				templates: githubURLTemplates,
 			},
 		},
@@ -462,9 +495,117 @@ func TestModuleImportDynamic(t *testing.T) {
 				repoURL:   "https://github.com/alice/pkg",
 				moduleDir: "default",
 				commit:    "default/v1.2.3",
+				refKind:   tagRef,
+				templates: githubURLTemplates,
+			},
+		},
+		{
+			"carol.org/pkg",
+			// Mercurial repo served by hgweb.
+			&Info{
+				repoURL:   "https://hg.carol.org/pkg",
+				moduleDir: "",
+				commit:    "v1.2.3",
+				refKind:   tagRef,
+				templates: urlTemplates{
+					Directory: "{repo}/file/{commit}/{dir}",
+					File:      "{repo}/file/{commit}/{file}",
+					Line:      "{repo}/file/{commit}/{file}#l{line}",
+					Raw:       "{repo}/raw-file/{commit}/{file}",
+				},
+			},
+		},
+		{
+			"grace.org/ssh",
+			&Info{
+				repoURL:   "https://github.com/grace/ssh",
+				moduleDir: "",
+				commit:    "v1.2.3",
+				refKind:   tagRef,
+				templates: githubURLTemplates,
+			},
+		},
+		{
+			"grace.org/git",
+			&Info{
+				repoURL:   "https://gitlab.com/grace/git",
+				moduleDir: "",
+				commit:    "v1.2.3",
+				refKind:   tagRef,
+				templates: gitlabURLTemplates,
+			},
+		},
+		{
+			"frank.org/pkg",
+			&Info{
+				repoURL:   "https://github.com/frank/pkg",
+				moduleDir: "",
+				commit:    "v1.2.3",
+				refKind:   tagRef,
 				templates: githubURLTemplates,
 			},
 		},
+		{
+			"heidi.org/pkg",
+			// Legacy go-source templates.
+			&Info{
+				repoURL:   "https://hg.heidi.org/pkg",
+				moduleDir: "",
+				commit:    "v1.2.3",
+				refKind:   tagRef,
+				templates: urlTemplates{
+					Directory: "{repo}/file/{commit}/{dir}",
+					File:      "{repo}/file/{commit}/{file}",
+					Line:      "{repo}/file/{commit}/{file}#l{line}",
+					Raw:       "{repo}/raw-file/{commit}/{file}",
+				},
+			},
+		},
+		{
+			"ivan.org/pkg",
+			&Info{
+				repoURL:   "https://git.ivan.org/pkg",
+				moduleDir: "",
+				commit:    "v1.2.3",
+				refKind:   tagRef,
+				templates: gitilesURLTemplates,
+			},
+		},
+		{
+			"judy.org/pkg",
+			&Info{
+				repoURL:   "https://git.judy.org/pkg",
+				moduleDir: "",
+				commit:    "v1.2.3",
+				refKind:   tagRef,
+				templates: cgitURLTemplates,
+			},
+		},
+		{
+			"heidi.org/none",
+			&Info{
+				repoURL:   "https://git.heidi.org/none",
+				moduleDir: "",
+				commit:    "v1.2.3",
+				refKind:   tagRef,
+			},
+		},
+		{
+			"erin.org/pkg",
+			// Relative go-source templates.
+			&Info{
+				repoURL:   "https://hg.erin.org/pkg",
+				moduleDir: "",
+				commit:    "v1.2.3",
+				refKind:   tagRef,
+				templates: urlTemplates{
+					Directory: "{repo}/file/{commit}/{dir}",
+					File:      "{repo}/file/{commit}/{file}",
+					Line:      "{repo}/file/{commit}/{file}#l{line}",
+					Raw:       "{repo}/raw-file/{commit}/{file}",
+				},
+			},
+		},
 	} {
 		t.Run(test.modulePath, func(t *testing.T) {
 			got, err := moduleInfoDynamic(context.Background(), client, test.modulePath, version)
@@ -582,6 +723,42 @@ func TestAdjustVersionedModuleDirectory(t *testing.T) {
 	}
 }
 
+// TestMajorSubdirectoryURLs checks that the URLs of a module at major version 2
+// link into its "v2" directory only if it follows the "major subdirectory"
+// convention.
+func TestMajorSubdirectoryURLs(t *testing.T) {
+	client := NewClient(testTimeout)
+	client.httpClient.Transport = testTransport(map[string]string{
+		"https://github.com/foo/sub/blob/v2.0.0/v2/go.mod": "",
+		"https://github.com/foo/branch/blob/v2.0.0/go.mod": "",
+	})
+	for _, test := range []struct {
+		modulePath, wantDir, wantFile string
+	}{
+		{
+			"github.com/foo/sub/v2",
+			"https://github.com/foo/sub/tree/v2.0.0/v2",
+			"https://github.com/foo/sub/blob/v2.0.0/v2/baz.go",
+		},
+		{
+			"github.com/foo/branch/v2",
+			"https://github.com/foo/branch/tree/v2.0.0",
+			"https://github.com/foo/branch/blob/v2.0.0/baz.go",
+		},
+	} {
+		info, err := ModuleInfo(context.Background(), client, test.modulePath, "v2.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.ModuleURL(); got != test.wantDir {
+			t.Errorf("%s: ModuleURL: got %q, want %q", test.modulePath, got, test.wantDir)
+		}
+		if got := info.FileURL("baz.go"); got != test.wantFile {
+			t.Errorf("%s: FileURL: got %q, want %q", test.modulePath, got, test.wantFile)
+		}
+	}
+}
+
 func TestCommitFromVersion(t *testing.T) {
 	for _, test := range []struct {
 		version, dir string
@@ -619,6 +796,69 @@ func TestCommitFromVersion(t *testing.T) {
 			"v6.1.1-0.20190615154606-3a9541ec9974", "foo",
 			"3a9541ec9974",
 		},
+		// Pseudo-versions for major versions 2 and higher without a go.mod
+		// file; the "+incompatible" must not end up in the commit.
+		{
+			"v2.0.0-20200101000000-abcdef123456+incompatible", "",
+			"abcdef123456",
+		},
+		{
+			"v2.0.1-0.20200101000000-abcdef123456+incompatible", "foo",
+			"abcdef123456",
+		},
+		// Other build metadata isn't part of the tag either.
+		{
+			"v1.2.3+build.5", "",
+			"v1.2.3",
+		},
+		{
+			"v1.2.3-rc.1+build.5", "foo",
+			"foo/v1.2.3-rc.1",
+		},
+		{
+			"v1.5.0-0.20200101000000-abcdef123456+build.5", "foo",
+			"abcdef123456",
+		},
+		// Versions that are typically retracted look like any others.
+		{
+			"v1.0.0-retracted", "",
+			"v1.0.0-retracted",
+		},
+		{
+			"v0.9.9-rc.1", "foo",
+			"foo/v0.9.9-rc.1",
+		},
+		{
+			"v1.5.0-0.20200101000000-abcdef123456", "foo",
+			"abcdef123456",
+		},
+		// Branch names are not prefixed by the module's directory.
+		{
+			"main", "",
+			"main",
+		},
+		{
+			"main", "foo",
+			"main",
+		},
+		// Strings that look like hashes are treated as branch names, and a
+		// go.sum hash is never used for the commit.
+		{
+			"3a9541ec9974", "foo",
+			"3a9541ec9974",
+		},
+		{
+			"h1:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", "",
+			"h1:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		},
+		{
+			"v1.2.3-20190615154606-", "",
+			"v1.2.3-20190615154606-",
+		},
+		{
+			"-0.20190615154606-3a9541ec9974", "foo",
+			"-0.20190615154606-3a9541ec9974",
+		},
 	} {
 		t.Run(fmt.Sprintf("%s,%s", test.version, test.dir), func(t *testing.T) {
 			if got := commitFromVersion(test.version, test.dir); got != test.want {
@@ -692,6 +932,46 @@ var testWeb = map[string]string{
 		<meta name="go-import" content="alice.org/pkg git https://github.com/alice/pkg">
 		<meta name="go-source" content="alice.org/pkg _ foo bar">
 	</head>`,
+	// Package in a Mercurial repo served by hgweb.
+	"https://carol.org/pkg": `<head>` +
+		`<meta name="go-import" content="carol.org/pkg hg https://hg.carol.org/pkg">` +
+		`<meta name="go-source" content="carol.org/pkg https://hg.carol.org/pkg https://hg.carol.org/pkg/file/tip{/dir} https://hg.carol.org/pkg/file/tip{/dir}/{file}#l{line}">` +
+		`</head>`,
+	// Package whose meta tags are only served at a URL with a trailing slash.
+	"https://dave.org/pkg/": `<head> <meta name="go-import" content="dave.org/pkg git https://github.com/dave/pkg"></head>`,
+	// Package in a Mercurial repo, with go-source templates relative to the repo URL.
+	"https://erin.org/pkg": `<head>` +
+		`<meta name="go-import" content="erin.org/pkg hg https://hg.erin.org/pkg">` +
+		`<meta name="go-source" content="erin.org/pkg https://hg.erin.org/pkg /file/tip{/dir} /file/tip{/dir}/{file}#l{line}">` +
+		`</head>`,
+	// Package in a GitHub repo whose URL has a ".git" suffix.
+	"https://frank.org/pkg": `<head> <meta name="go-import" content="frank.org/pkg git https://github.com/frank/pkg.git"></head>`,
+	// Packages with only go-import tags, whose repo URLs are for protocols
+	// other than https.
+	"https://grace.org/ssh": `<head> <meta name="go-import" content="grace.org/ssh git ssh://git@github.com/grace/ssh.git"></head>`,
+	"https://grace.org/git": `<head> <meta name="go-import" content="grace.org/git git git://gitlab.com/grace/git"></head>`,
+	// Vanity path for a repo on a Gitea server.
+	"https://modernc.org/sqlite": `<head> <meta name="go-import" content="modernc.org/sqlite git https://git.modernc.org/cznic/sqlite"></head>`,
+	// Packages on personal vanity hosts, with go-source templates for git
+	// repos served by gitiles and cgit.
+	"https://ivan.org/pkg": `<head>` +
+		`<meta name="go-import" content="ivan.org/pkg git https://ivan.org/pkg">` +
+		`<meta name="go-source" content="ivan.org/pkg https://ivan.org/pkg https://git.ivan.org/pkg/+/master{/dir} https://git.ivan.org/pkg/+/master{/dir}/{file}#{line}">` +
+		`</head>`,
+	"https://judy.org/pkg": `<head>` +
+		`<meta name="go-import" content="judy.org/pkg git https://judy.org/pkg">` +
+		`<meta name="go-source" content="judy.org/pkg https://judy.org/pkg https://git.judy.org/pkg/tree{/dir}?h=master https://git.judy.org/pkg/tree{/dir}/{file}?h=master#n{line}">` +
+		`</head>`,
+	// Package in a Mercurial repo, with go-source templates in a legacy format.
+	"https://heidi.org/pkg": `<head>` +
+		`<meta name="go-import" content="heidi.org/pkg hg https://hg.heidi.org/pkg">` +
+		`<meta name="go-source" content="heidi.org/pkg _ https://hg.heidi.org/pkg/file/tip/{dir} https://hg.heidi.org/pkg/file/tip/{dir}/{file}#l{line}">` +
+		`</head>`,
+	// Package whose go-source tag has no templates.
+	"https://heidi.org/none": `<head>` +
+		`<meta name="go-import" content="heidi.org/none git https://git.heidi.org/none">` +
+		`<meta name="go-source" content="heidi.org/none _ _ _">` +
+		`</head>`,
 	// Package at root of a Git repo.
 	"https://bob.com/pkg": `<head> <meta name="go-import" content="bob.com/pkg git https://vcs.net/bob/pkg.git">`,
 	// Package at in sub-directory of a Git repo.
@@ -757,3 +1037,2159 @@ func TestJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestIssueTrackerURL(t *testing.T) {
+	for _, test := range []struct {
+		desc      string
+		templates urlTemplates
+		want      string
+	}{
+		{"github", githubURLTemplates, "https://host.com/a/b/issues"},
+		{"gitlab", gitlabURLTemplates, "https://host.com/a/b/-/issues"},
+		{"bitbucket", bitbucketURLTemplates, "https://host.com/a/b/issues"},
+		{"unknown", urlTemplates{}, ""},
+	} {
+		info := &Info{repoURL: "https://host.com/a/b", templates: test.templates}
+		if got := info.IssueTrackerURL(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestUnescapeModulePath(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"github.com/a/b", "github.com/a/b"},
+		{"github.com/a/b%2Dc", "github.com/a/b-c"},
+		{"github.com%2Fa%2Fb", "github.com/a/b"},
+		{"github.com/!a/b", "github.com/!a/b"}, // case-encoding is left alone
+	} {
+		got, err := unescapeModulePath(test.in)
+		if err != nil {
+			t.Fatalf("%q: %v", test.in, err)
+		}
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+	}
+
+	if _, err := unescapeModulePath("github.com/a/b%zz"); !errors.Is(err, derrors.InvalidArgument) {
+		t.Errorf("bad escape: got %v, want InvalidArgument", err)
+	}
+
+	info, err := ModuleInfo(context.Background(), nil, "github.com/hashicorp/consul%2Fsdk", "v0.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "https://github.com/hashicorp/consul/blob/sdk/v0.2.0/sdk/freeport/freeport.go"
+	if got := info.FileURL("freeport/freeport.go"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestUnescapeVersion(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"v1.0.0", "v1.0.0"},
+		{"v1.0.0-!r!c1", "v1.0.0-RC1"},
+		{"v2.0.0%2Bincompatible", "v2.0.0+incompatible"},
+		{"main", "main"},
+	} {
+		got, err := unescapeVersion(test.in)
+		if err != nil {
+			t.Fatalf("%q: %v", test.in, err)
+		}
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+	}
+	for _, bad := range []string{"v1.0.0%zz", "v1.0.0-!!"} {
+		if _, err := unescapeVersion(bad); !errors.Is(err, derrors.InvalidArgument) {
+			t.Errorf("%q: got %v, want InvalidArgument", bad, err)
+		}
+	}
+
+	info, err := ModuleInfo(context.Background(), nil, "github.com/a/b/sub", "v1.0.0-!r!c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.FileURL("f.go"), "https://github.com/a/b/blob/sub/v1.0.0-RC1/sub/f.go"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSubmoduleFileURL(t *testing.T) {
+	info := NewGitHubInfo("https://github.com/a/b", "mod", "v1.2.3")
+	subs := []Submodule{
+		{Path: "mod/third_party/c", RepoURL: "https://gitlab.com/x/c.git", Commit: "abcdef"},
+		{Path: "mod/third_party/d", RepoURL: "https://private.example.com/d", Commit: "123456"},
+		{Path: "mod/third_party/e", Commit: "123456"},
+	}
+	for _, test := range []struct {
+		file, want string
+	}{
+		{"main.go", "https://github.com/a/b/blob/v1.2.3/mod/main.go"},
+		{"third_party/c/c.go", "https://gitlab.com/x/c/blob/abcdef/c.go"},
+		{"third_party/c/sub/c.go", "https://gitlab.com/x/c/blob/abcdef/sub/c.go"},
+		{"third_party/cc/c.go", "https://github.com/a/b/blob/v1.2.3/mod/third_party/cc/c.go"},
+		{"third_party/d/d.go", ""},
+		{"third_party/e/e.go", ""},
+	} {
+		if got := info.SubmoduleFileURL(test.file, subs); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.file, got, test.want)
+		}
+	}
+}
+
+func TestHgwebTemplates(t *testing.T) {
+	const repo = "https://hg.example.com/r"
+	for _, test := range []struct {
+		desc              string
+		vcs, dir, file    string
+		wantDir, wantLine string
+		wantOK            bool
+	}{
+		{
+			"tip",
+			"hg", repo + "/file/tip{/dir}", repo + "/file/tip{/dir}/{file}#l{line}",
+			repo + "/file/v1.0.0/d", repo + "/file/v1.0.0/d/f.go#l3",
+			true,
+		},
+		{
+			"default branch, no anchor",
+			"hg", repo + "/file/default{/dir}", repo + "/file/default{/dir}/{file}",
+			repo + "/file/v1.0.0/d", repo + "/file/v1.0.0/d/f.go#l3",
+			true,
+		},
+		{
+			"@ revision, upper-case anchor",
+			"hg", repo + "/file/@{/dir}", repo + "/file/@{/dir}/{file}#L{line}",
+			repo + "/file/v1.0.0/d", repo + "/file/v1.0.0/d/f.go#L3",
+			true,
+		},
+		{
+			"git",
+			"git", repo + "/file/tip{/dir}", repo + "/file/tip{/dir}/{file}#l{line}",
+			"", "",
+			false,
+		},
+		{
+			"not hgweb",
+			"hg", repo + "/src{/dir}", repo + "/src{/dir}/{file}#l{line}",
+			"", "",
+			false,
+		},
+		{
+			"mismatched file template",
+			"hg", repo + "/file/tip{/dir}", repo + "/other/tip{/dir}/{file}#l{line}",
+			"", "",
+			false,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			gotRepo, templates, ok := hgwebTemplates(&SourceMeta{VCS: test.vcs, DirTemplate: test.dir, FileTemplate: test.file})
+			if ok != test.wantOK {
+				t.Fatalf("got ok=%t, want %t", ok, test.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if gotRepo != repo {
+				t.Errorf("got repo %q, want %q", gotRepo, repo)
+			}
+			info := &Info{repoURL: gotRepo, moduleDir: "d", commit: "v1.0.0", templates: templates}
+			if got := info.ModuleURL(); got != test.wantDir {
+				t.Errorf("dir: got %q, want %q", got, test.wantDir)
+			}
+			if got := info.LineURL("f.go", 3); got != test.wantLine {
+				t.Errorf("line: got %q, want %q", got, test.wantLine)
+			}
+		})
+	}
+}
+
+func TestCompareURL(t *testing.T) {
+	for _, test := range []struct {
+		desc      string
+		templates urlTemplates
+		want      string
+	}{
+		{"github", githubURLTemplates, "https://host.com/a/b/compare/v1.0.0...v1.1.0"},
+		{"gitlab", gitlabURLTemplates, "https://host.com/a/b/-/compare/v1.0.0...v1.1.0"},
+		{"bitbucket", bitbucketURLTemplates, "https://host.com/a/b/branches/compare/v1.1.0%0Dv1.0.0"},
+		{"unknown", urlTemplates{}, ""},
+	} {
+		info := &Info{repoURL: "https://host.com/a/b", commit: "v1.1.0", templates: test.templates}
+		if got := info.CompareURL("v1.0.0"); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, got, test.want)
+		}
+	}
+	// The other commit is escaped like the commit, keeping its slashes.
+	info := &Info{repoURL: "https://host.com/a/b", commit: "sub/v1.1.0", templates: githubURLTemplates}
+	for _, test := range []struct {
+		otherCommit, want string
+	}{
+		{"sub/v0.9.0", "https://host.com/a/b/compare/sub/v0.9.0...sub/v1.1.0"},
+		{"fix#1", "https://host.com/a/b/compare/fix%231...sub/v1.1.0"},
+		{"a?b%c", "https://host.com/a/b/compare/a%3Fb%25c...sub/v1.1.0"},
+	} {
+		if got := info.CompareURL(test.otherCommit); got != test.want {
+			t.Errorf("CompareURL(%q): got %q, want %q", test.otherCommit, got, test.want)
+		}
+	}
+}
+
+func TestLogURL(t *testing.T) {
+	for _, test := range []struct {
+		desc           string
+		templates      urlTemplates
+		moduleDir, dir string
+		want           string
+	}{
+		{"sourcehut", sourcehutURLTemplates, "", "", "https://host.com/a/b/log/v1.1.0"},
+		{"sourcehut dir", sourcehutURLTemplates, "", "c", "https://host.com/a/b/log/v1.1.0/item/c"},
+		{"sourcehut module", sourcehutURLTemplates, "m", "", "https://host.com/a/b/log/v1.1.0/item/m"},
+		{"sourcehut module dir", sourcehutURLTemplates, "m", "c/d", "https://host.com/a/b/log/v1.1.0/item/m/c/d"},
+		{"gitiles", gitilesURLTemplates, "", "", "https://host.com/a/b/+log/v1.1.0"},
+		{"gitiles dir", gitilesURLTemplates, "", "c", "https://host.com/a/b/+log/v1.1.0/c"},
+		{"unknown", urlTemplates{}, "", "c", ""},
+	} {
+		info := &Info{repoURL: "https://host.com/a/b", moduleDir: test.moduleDir, commit: "v1.1.0", templates: test.templates}
+		if got := info.DirectoryLogURL(test.dir); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestModuleInfoMalformedPaths(t *testing.T) {
+	// None of these paths should cause a panic. Those that cannot be module
+	// paths should fail with ErrNoSourceInfo without making a request.
+	var nRequests int
+	client := &Client{
+		httpClient: &http.Client{
+			Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				nRequests++
+				return testTransport(nil).RoundTrip(r)
+			}),
+		},
+	}
+	for _, path := range []string{
+		"",
+		"/",
+		"myhost:repo/pkg",
+		"git@github.com:a/b",
+		"ssh://git@host.com/a/b",
+		"host.com:22/a/b",
+		"[::1]/a/b",
+		"a b.com/c",
+		"a.com/b\x00c",
+		"a.com//b",
+		"a.com/b/",
+		"a.com/../b",
+		"github.com/",
+		".git",
+		"gitlab./a/b",
+		"http://example.com/a",
+	} {
+		t.Run(path, func(t *testing.T) {
+			nRequests = 0
+			_, err := ModuleInfo(context.Background(), client, path, "v1.0.0")
+			if !errors.Is(err, ErrNoSourceInfo) {
+				t.Errorf("got error %v, want ErrNoSourceInfo", err)
+			}
+			if nRequests > 0 {
+				t.Errorf("made %d requests, want none", nRequests)
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestReleaseURL(t *testing.T) {
+	for _, test := range []struct {
+		desc      string
+		templates urlTemplates
+		want      string
+	}{
+		{"github", githubURLTemplates, "https://host.com/a/b/releases/tag/v1.1.0"},
+		{"gitlab", gitlabURLTemplates, "https://host.com/a/b/-/releases/v1.1.0"},
+		{"bitbucket", bitbucketURLTemplates, ""},
+		{"unknown", urlTemplates{}, ""},
+	} {
+		info := &Info{repoURL: "https://host.com/a/b", commit: "v1.1.0", templates: test.templates}
+		if got := info.ReleaseURL("v1.1.0"); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestAbsoluteTemplate(t *testing.T) {
+	const repo = "https://x.com/r"
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"_", "_"},
+		{"https://y.com/s{/dir}", "https://y.com/s{/dir}"},
+		{"http://y.com/s{/dir}", "http://y.com/s{/dir}"},
+		{"{/dir}", "https://x.com/r{/dir}"},
+		{"/tree/master{/dir}", "https://x.com/r/tree/master{/dir}"},
+		{"tree/master{/dir}", "https://x.com/r/tree/master{/dir}"},
+	} {
+		for _, r := range []string{repo, repo + "/"} {
+			if got := absoluteTemplate(r, test.in); got != test.want {
+				t.Errorf("absoluteTemplate(%q, %q) = %q, want %q", r, test.in, got, test.want)
+			}
+		}
+	}
+}
+
+func TestLegacyTemplate(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"_", noTemplate},
+		{"https://y.com/s{/dir}", "https://y.com/s{/dir}"},
+		{"https://y.com/s/{dir}", "https://y.com/s{/dir}"},
+		{"https://y.com/s/{dir}/{file}#L{line}", "https://y.com/s{/dir}/{file}#L{line}"},
+	} {
+		if got := legacyTemplate(test.in); got != test.want {
+			t.Errorf("legacyTemplate(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestNoTemplate(t *testing.T) {
+	info := &Info{
+		repoURL: "https://x.com/r",
+		commit:  "v1.2.3",
+		templates: urlTemplates{
+			Directory: "{repo}/tree/{commit}/{dir}",
+			File:      legacyTemplate("_"),
+			Raw:       legacyTemplate("_"),
+		},
+	}
+	if got := info.FileURL("f.go"); got != "" {
+		t.Errorf("FileURL: got %q, want empty", got)
+	}
+	if got := info.RawURL("f.go"); got != "" {
+		t.Errorf("RawURL: got %q, want empty", got)
+	}
+	if got, want := info.DirectoryURL("d"), "https://x.com/r/tree/v1.2.3/d"; got != want {
+		t.Errorf("DirectoryURL: got %q, want %q", got, want)
+	}
+}
+
+func TestRepoRootPrefix(t *testing.T) {
+	for _, test := range []struct {
+		in     string
+		want   string
+		wantOK bool
+	}{
+		{"github.com/a/b", "github.com/a/b", true},
+		{"github.com/a/b/c", "github.com/a/b", true},
+		{"github.com/a/b/c/d/v2", "github.com/a/b", true},
+		{"gitlab.com/a/b/c", "gitlab.com/a/b", true},
+		{"example.com/a/b.git/c", "example.com/a/b.git", true},
+		{"git.apache.org/thrift.git/lib", "git.apache.org/thrift.git", true},
+		{"golang.org/x/tools", "", false},
+	} {
+		got, ok := RepoRootPrefix(test.in)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("RepoRootPrefix(%q) = %q, %t; want %q, %t", test.in, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestNestedModuleVersusPackage(t *testing.T) {
+	ctx := context.Background()
+	// github.com/a/b is a module with a package in directory "pkg", and
+	// github.com/a/b/nested is a separate module.
+	mod, err := ModuleInfo(ctx, nil, "github.com/a/b", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested, err := ModuleInfo(ctx, nil, "github.com/a/b/nested", "v0.3.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		got, want string
+	}{
+		{mod.DirectoryURL("pkg"), "https://github.com/a/b/tree/v1.0.0/pkg"},
+		{mod.FileURL("pkg/p.go"), "https://github.com/a/b/blob/v1.0.0/pkg/p.go"},
+		{nested.ModuleURL(), "https://github.com/a/b/tree/nested/v0.3.0/nested"},
+		{nested.DirectoryURL("pkg"), "https://github.com/a/b/tree/nested/v0.3.0/nested/pkg"},
+		{nested.FileURL("pkg/p.go"), "https://github.com/a/b/blob/nested/v0.3.0/nested/pkg/p.go"},
+	} {
+		if test.got != test.want {
+			t.Errorf("got %q, want %q", test.got, test.want)
+		}
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		opts        Options
+		wantAllowed bool
+	}{
+		{"no lists", Options{}, true},
+		{"allowed", Options{AllowedHosts: []string{"other.org", "alice.org"}}, true},
+		{"not allowed", Options{AllowedHosts: []string{"other.org"}}, false},
+		{"denied", Options{DeniedHosts: []string{"alice.org"}}, false},
+		{"allowed and denied", Options{AllowedHosts: []string{"alice.org"}, DeniedHosts: []string{"alice.org"}}, false},
+		{"other denied", Options{DeniedHosts: []string{"other.org"}}, true},
+		{"allowed mixed case", Options{AllowedHosts: []string{"Alice.ORG"}}, true},
+		{"denied mixed case", Options{DeniedHosts: []string{"ALICE.org"}}, false},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var nRequests int
+			client := NewClientWithOptions(testTimeout, test.opts)
+			client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				nRequests++
+				return testTransport(testWeb).RoundTrip(r)
+			})
+			info, err := ModuleInfo(context.Background(), client, "alice.org/pkg", "v1.0.0")
+			if test.wantAllowed {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := info.RepoURL(), "https://github.com/alice/pkg"; got != want {
+					t.Errorf("got %q, want %q", got, want)
+				}
+				return
+			}
+			if !errors.Is(err, ErrNoSourceInfo) {
+				t.Errorf("got error %v, want ErrNoSourceInfo", err)
+			}
+			if nRequests > 0 {
+				t.Errorf("made %d requests, want none", nRequests)
+			}
+		})
+	}
+}
+
+func TestPathRewrites(t *testing.T) {
+	client := NewClientWithOptions(testTimeout, Options{
+		PathRewrites: []PathRewrite{
+			{From: "proxy.corp/github.com", To: "github.com"},
+			{From: "proxy.corp/", To: "gitlab.com/"},
+		},
+	})
+	for _, test := range []struct {
+		modulePath string
+		want       string
+	}{
+		{"proxy.corp/github.com/a/b", "https://github.com/a/b/blob/v1.0.0/f.go"},
+		{"proxy.corp/github.com/a/b/sub", "https://github.com/a/b/blob/sub/v1.0.0/sub/f.go"},
+		{"proxy.corp/a/b", "https://gitlab.com/a/b/blob/v1.0.0/f.go"},
+		{"github.com/a/b", "https://github.com/a/b/blob/v1.0.0/f.go"},
+	} {
+		info, err := ModuleInfo(context.Background(), client, test.modulePath, "v1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.FileURL("f.go"); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.modulePath, got, test.want)
+		}
+	}
+
+	// A rewrite must match whole path elements.
+	if got, want := client.rewritePath("proxy.corporate/a/b"), "proxy.corporate/a/b"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStdlibInfo(t *testing.T) {
+	for _, test := range []struct {
+		version  string
+		wantFile string
+		wantErr  error
+	}{
+		{"v1.0.0", "https://github.com/golang/go/blob/go1/src/pkg/bytes/buffer.go", nil},
+		{"v1.3.3", "https://github.com/golang/go/blob/go1.3.3/src/pkg/bytes/buffer.go", nil},
+		{"v1.4.0", "https://github.com/golang/go/blob/go1.4/src/bytes/buffer.go", nil},
+		{"v0.9.0", "", derrors.NotFound},
+		{"v0.0.0-20090101000000-abcdef123456", "", derrors.NotFound},
+		{"1.14", "", derrors.InvalidArgument},
+		{"v1.14.0-beta1", "", derrors.InvalidArgument},
+	} {
+		t.Run(test.version, func(t *testing.T) {
+			info, err := ModuleInfo(context.Background(), nil, "std", test.version)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("got error %v, want %v", err, test.wantErr)
+				}
+				if test.wantErr == derrors.InvalidArgument && errors.Is(err, derrors.NotFound) {
+					t.Errorf("got error %v, which should not be NotFound", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.FileURL("bytes/buffer.go"); got != test.wantFile {
+				t.Errorf("got %q, want %q", got, test.wantFile)
+			}
+		})
+	}
+}
+
+func TestLineURL(t *testing.T) {
+	info := NewGitHubInfo("https://github.com/a/b", "", "v1.0.0")
+	for _, test := range []struct {
+		line int
+		want string
+	}{
+		{1, "https://github.com/a/b/blob/v1.0.0/f.pb.go#L1"},
+		{1234, "https://github.com/a/b/blob/v1.0.0/f.pb.go#L1234"},
+		{0, "https://github.com/a/b/blob/v1.0.0/f.pb.go"},
+		{-5, "https://github.com/a/b/blob/v1.0.0/f.pb.go"},
+	} {
+		if got := info.LineURL("f.pb.go", test.line); got != test.want {
+			t.Errorf("%d: got %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestPseudoVersionBase(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"v0.0.0-20200101000000-abcdef123456", ""},
+		{"v2.0.0-20200101000000-abcdef123456+incompatible", ""},
+		{"v1.2.4-0.20200101000000-abcdef123456", "v1.2.3"},
+		{"v1.2.10-0.20200101000000-abcdef123456", "v1.2.9"},
+		{"v2.0.1-0.20200101000000-abcdef123456+incompatible", "v2.0.0+incompatible"},
+		{"v1.2.3-pre.0.20200101000000-abcdef123456", "v1.2.3-pre"},
+		{"v1.2.3-rc.1.0.20200101000000-abcdef123456", "v1.2.3-rc.1"},
+	} {
+		got, err := PseudoVersionBase(test.in)
+		if err != nil {
+			t.Fatalf("%s: %v", test.in, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.in, got, test.want)
+		}
+	}
+	for _, in := range []string{"v1.2.3", "master", "v1.2.0-0.20200101000000-abcdef123456", ""} {
+		if got, err := PseudoVersionBase(in); !errors.Is(err, derrors.InvalidArgument) {
+			t.Errorf("%s: got %q, %v; want InvalidArgument", in, got, err)
+		}
+	}
+}
+
+func TestWellKnownRewrites(t *testing.T) {
+	for _, test := range []struct {
+		modulePath, version string
+		want                string
+	}{
+		{"go.uber.org/zap", "v1.15.0", "https://github.com/uber-go/zap/blob/v1.15.0/f.go"},
+		{"gocloud.dev", "v0.20.0", "https://github.com/google/go-cloud/blob/v0.20.0/f.go"},
+		{"k8s.io/klog/v2", "v2.3.0", "https://github.com/kubernetes/klog/blob/v2.3.0/f.go"},
+		{"golang.org/dl", "v0.0.0-20200601221412-a954fa24b3e5", "https://go.googlesource.com/dl/+/a954fa24b3e5/f.go"},
+		{"cloud.google.com/go/spanner", "v1.0.0", "https://github.com/googleapis/google-cloud-go/blob/spanner/v1.0.0/spanner/f.go"},
+	} {
+		// The client fails all requests, so resolution must be static. The
+		// check for a "v2" directory fails, so it is assumed not to exist.
+		client := &Client{
+			httpClient: &http.Client{Transport: testTransport(nil)},
+			opts:       Options{WellKnownRewrites: true},
+		}
+		info, err := ModuleInfo(context.Background(), client, test.modulePath, test.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.FileURL("f.go"); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.modulePath, got, test.want)
+		}
+	}
+
+	// Options.PathRewrites take precedence.
+	client := NewClientWithOptions(testTimeout, Options{
+		PathRewrites:      []PathRewrite{{From: "go.uber.org/zap", To: "gitlab.com/fork/zap"}},
+		WellKnownRewrites: true,
+	})
+	if got, want := client.rewritePath("go.uber.org/zap"), "gitlab.com/fork/zap"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Without the option, or a client, paths are not rewritten, so that
+	// their meta tags are used.
+	for _, c := range []*Client{nil, NewClient(testTimeout)} {
+		if got, want := c.rewritePath("go.uber.org/zap"), "go.uber.org/zap"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if _, err := ModuleInfo(context.Background(), nil, "go.uber.org/zap", "v1.15.0"); !errors.Is(err, ErrNoSourceInfo) {
+		t.Errorf("got error %v, want ErrNoSourceInfo", err)
+	}
+}
+
+func TestWithOptions(t *testing.T) {
+	client := NewClient(testTimeout)
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected request for %s", r.URL)
+		return nil, errors.New("no requests allowed")
+	})
+	ctx := WithOptions(context.Background(), Options{StaticOnly: true, DefaultRef: "main"})
+
+	// Paths that need meta tags are not resolved.
+	if _, err := ModuleInfo(ctx, client, "vanity.example.com/pkg", "v1.0.0"); !errors.Is(err, ErrNoSourceInfo) {
+		t.Errorf("got error %v, want ErrNoSourceInfo", err)
+	}
+	// The "v2" directory is assumed not to exist, rather than checked, and the
+	// default ref comes from the context.
+	info, err := ModuleInfo(ctx, client, "github.com/a/b/v2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.FileURL("f.go"), "https://github.com/a/b/blob/main/f.go"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Options apply with a nil client, too.
+	info, err = ModuleInfo(ctx, nil, "github.com/a/b", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.FileURL("f.go"), "https://github.com/a/b/blob/main/f.go"; got != want {
+		t.Errorf("nil client: got %q, want %q", got, want)
+	}
+}
+
+func TestWithOptionsSharesState(t *testing.T) {
+	ctx := context.Background()
+	var nRequests int
+	client := NewClientWithOptions(testTimeout, Options{
+		CommitResolver: fakeResolver{branches: map[string]string{"https://github.com/a/b": "trunk"}},
+	})
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		nRequests++
+		return &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+			Status:     "429 Too Many Requests",
+			Header:     http.Header{"Retry-After": []string{"120"}},
+			Body:       http.NoBody,
+		}, nil
+	})
+	if _, err := client.doURL(ctx, "GET", "https://limited.com/a", true); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("got error %v, want ErrRateLimited", err)
+	}
+	info := NewGitHubInfo("https://github.com/a/b", "", "v1.0.0")
+	if _, err := client.DefaultBranch(ctx, info); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client for other options knows that the host limited the rate of
+	// requests, and the default branch that was found.
+	child := client.withOptions(Options{})
+	if _, err := child.doURL(ctx, "GET", "https://limited.com/b", true); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("got error %v, want ErrRateLimited", err)
+	}
+	if got, err := child.DefaultBranch(ctx, info); err != nil || got != "trunk" {
+		t.Errorf("DefaultBranch: got %q, %v, want %q, nil", got, err, "trunk")
+	}
+	if nRequests != 1 {
+		t.Errorf("got %d requests, want 1", nRequests)
+	}
+}
+
+func TestURLsWithoutTemplates(t *testing.T) {
+	// A module on a host that matches only the general go command syntax.
+	info, err := ModuleInfo(context.Background(), nil, "git.example.com/repo.git/dir", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.RepoURL(), "https://git.example.com/repo"; got != want {
+		t.Errorf("RepoURL: got %q, want %q", got, want)
+	}
+	for _, test := range []struct {
+		desc, got string
+	}{
+		{"ModuleURL", info.ModuleURL()},
+		{"DirectoryURL", info.DirectoryURL("a/b")},
+		{"FileURL", info.FileURL("a/b.go")},
+		{"LineURL", info.LineURL("a/b.go", 3)},
+		{"RawURL", info.RawURL("a/b.go")},
+		{"IssueTrackerURL", info.IssueTrackerURL()},
+		{"CompareURL", info.CompareURL("v0.9.0")},
+		{"ReleaseURL", info.ReleaseURL("v1.0.0")},
+	} {
+		if test.got != "" {
+			t.Errorf("%s: got %q, want empty", test.desc, test.got)
+		}
+	}
+}
+
+func TestLineRangeURL(t *testing.T) {
+	for _, test := range []struct {
+		desc       string
+		templates  urlTemplates
+		start, end int
+		want       string
+	}{
+		{"github", githubURLTemplates, 3, 7, "https://host.com/a/b/blob/v1.0.0/f.go#L3-L7"},
+		{"github single line", githubURLTemplates, 3, 3, "https://host.com/a/b/blob/v1.0.0/f.go#L3"},
+		{"github reversed", githubURLTemplates, 7, 3, "https://host.com/a/b/blob/v1.0.0/f.go#L7"},
+		// GitLab has no "L" before the end line.
+		{"gitlab", gitlabURLTemplates, 3, 7, "https://host.com/a/b/blob/v1.0.0/f.go#L3-7"},
+		{"gitlab single line", gitlabURLTemplates, 3, 3, "https://host.com/a/b/blob/v1.0.0/f.go#L3"},
+		{"bitbucket", bitbucketURLTemplates, 3, 7, "https://host.com/a/b/src/v1.0.0/f.go#lines-3:7"},
+		{"no range template", urlTemplates{Line: "{repo}/{file}#{line}"}, 3, 7, "https://host.com/a/b/f.go#3"},
+	} {
+		info := &Info{repoURL: "https://host.com/a/b", commit: "v1.0.0", templates: test.templates}
+		if got := info.LineRangeURL("f.go", test.start, test.end); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestModuleInfoWithCanonicalPath(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		modulePath, canonicalPath string
+		want                      string
+	}{
+		{"github.com/fork/b", "github.com/a/b", "https://github.com/a/b/blob/v1.0.0/f.go"},
+		{"github.com/fork/b", "", "https://github.com/fork/b/blob/v1.0.0/f.go"},
+		{"github.com/a/b", "github.com/a/b", "https://github.com/a/b/blob/v1.0.0/f.go"},
+	} {
+		info, err := ModuleInfoWithCanonicalPath(ctx, nil, test.modulePath, test.canonicalPath, "v1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.FileURL("f.go"); got != test.want {
+			t.Errorf("%q, %q: got %q, want %q", test.modulePath, test.canonicalPath, got, test.want)
+		}
+	}
+}
+
+func TestRepoBaseURL(t *testing.T) {
+	client := NewClientWithOptions(testTimeout, Options{RepoBaseURL: "http://localhost:8080/mirror/"})
+	info, err := ModuleInfo(context.Background(), client, "github.com/a/b/sub", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		got, want string
+	}{
+		{info.RepoURL(), "http://localhost:8080/mirror/a/b"},
+		{info.ModuleURL(), "http://localhost:8080/mirror/a/b/tree/sub/v1.0.0/sub"},
+		{info.FileURL("f.go"), "http://localhost:8080/mirror/a/b/blob/sub/v1.0.0/sub/f.go"},
+		{info.LineURL("f.go", 2), "http://localhost:8080/mirror/a/b/blob/sub/v1.0.0/sub/f.go#L2"},
+	} {
+		if test.got != test.want {
+			t.Errorf("got %q, want %q", test.got, test.want)
+		}
+	}
+
+	// Off by default.
+	info, err = ModuleInfo(context.Background(), NewClient(testTimeout), "github.com/a/b", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.RepoURL(), "https://github.com/a/b"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFollowRepoRedirects(t *testing.T) {
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Body: http.NoBody, Request: r}
+		switch r.URL.String() {
+		case "https://github.com/old/repo":
+			resp.StatusCode = http.StatusMovedPermanently
+			resp.Header.Set("Location", "https://github.com/new/repo")
+		case "https://github.com/new/repo":
+			resp.StatusCode = http.StatusOK
+		}
+		return resp, nil
+	})
+	for _, test := range []struct {
+		desc    string
+		follow  bool
+		path    string
+		wantURL string
+	}{
+		{"off", false, "github.com/old/repo", "https://github.com/old/repo"},
+		{"renamed", true, "github.com/old/repo", "https://github.com/new/repo"},
+		{"not renamed", true, "github.com/new/repo", "https://github.com/new/repo"},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			client := NewClientWithOptions(testTimeout, Options{FollowRepoRedirects: test.follow})
+			client.httpClient.Transport = transport
+			info, err := ModuleInfo(context.Background(), client, test.path, "v1.0.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.RepoURL(); got != test.wantURL {
+				t.Errorf("RepoURL: got %q, want %q", got, test.wantURL)
+			}
+			if got, want := info.FileURL("f.go"), test.wantURL+"/blob/v1.0.0/f.go"; got != want {
+				t.Errorf("FileURL: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPathURL(t *testing.T) {
+	info := NewGitHubInfo("https://github.com/a/b", "sub", "v1.0.0")
+	for _, test := range []struct {
+		isDir bool
+		want  string
+	}{
+		{true, "https://github.com/a/b/tree/v1.0.0/sub/p"},
+		{false, "https://github.com/a/b/blob/v1.0.0/sub/p"},
+	} {
+		if got := info.PathURL("p", test.isDir); got != test.want {
+			t.Errorf("isDir=%t: got %q, want %q", test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestEmptyInfo(t *testing.T) {
+	info := EmptyInfo("https://example.com/repo")
+	if got, want := info.RepoURL(), "https://example.com/repo"; got != want {
+		t.Errorf("RepoURL: got %q, want %q", got, want)
+	}
+	for _, test := range []struct {
+		desc, got string
+	}{
+		{"ModuleURL", info.ModuleURL()},
+		{"DirectoryURL", info.DirectoryURL("a/b")},
+		{"FileURL", info.FileURL("a/b.go")},
+		{"PathURL", info.PathURL("a", true)},
+		{"LineURL", info.LineURL("a/b.go", 3)},
+		{"LineRangeURL", info.LineRangeURL("a/b.go", 3, 5)},
+		{"RawURL", info.RawURL("a/b.go")},
+		{"IssueTrackerURL", info.IssueTrackerURL()},
+		{"CompareURL", info.CompareURL("v0.9.0")},
+		{"ReleaseURL", info.ReleaseURL("v1.0.0")},
+		{"SubmoduleFileURL", info.SubmoduleFileURL("a/b.go", nil)},
+	} {
+		if test.got != "" {
+			t.Errorf("%s: got %q, want empty", test.desc, test.got)
+		}
+	}
+}
+
+func TestAddGogsHost(t *testing.T) {
+	savePatterns(t)
+	AddGogsHost("gogs.example.com")
+	AddGiteaHost("gitea.example.com")
+
+	check := func(modulePath, wantFile, wantLine string) {
+		t.Helper()
+		info, err := ModuleInfo(context.Background(), nil, modulePath, "v1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.FileURL("f.go"); got != wantFile {
+			t.Errorf("%s: FileURL: got %q, want %q", modulePath, got, wantFile)
+		}
+		if got := info.LineURL("f.go", 3); got != wantLine {
+			t.Errorf("%s: LineURL: got %q, want %q", modulePath, got, wantLine)
+		}
+	}
+	check("gogs.example.com/a/b/sub",
+		"https://gogs.example.com/a/b/src/sub/v1.0.0/sub/f.go",
+		"https://gogs.example.com/a/b/src/sub/v1.0.0/sub/f.go#L3")
+	check("gitea.example.com/a/b",
+		"https://gitea.example.com/a/b/src/commit/v1.0.0/f.go",
+		"https://gitea.example.com/a/b/src/commit/v1.0.0/f.go#L3")
+
+	// The general syntax for the go command still matches last.
+	if _, _, _, err := matchStatic("example.com/a/b.git/c"); err != nil {
+		t.Errorf("general syntax: %v", err)
+	}
+}
+
+func TestLicenseURL(t *testing.T) {
+	for _, test := range []struct {
+		moduleDir, path, want string
+	}{
+		{"", "LICENSE", "https://github.com/a/b/blob/v1.0.0/LICENSE"},
+		{"", "third_party/x/LICENSE.md", "https://github.com/a/b/blob/v1.0.0/third_party/x/LICENSE.md"},
+		{"sub", "LICENSE", "https://github.com/a/b/blob/v1.0.0/sub/LICENSE"},
+		{"sub", "internal/COPYING", "https://github.com/a/b/blob/v1.0.0/sub/internal/COPYING"},
+	} {
+		info := NewGitHubInfo("https://github.com/a/b", test.moduleDir, "v1.0.0")
+		if got := info.LicenseURL(test.path); got != test.want {
+			t.Errorf("%q, %q: got %q, want %q", test.moduleDir, test.path, got, test.want)
+		}
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	t.Run("budget", func(t *testing.T) {
+		var nRequests int
+		client := NewClientWithOptions(testTimeout, Options{MaxRequests: 2, Insecure: true})
+		client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			nRequests++
+			return testTransport(testWeb).RoundTrip(r)
+		})
+		// The meta tags are only served over http, after two failed https requests.
+		_, err := ModuleInfo(context.Background(), client, "alice.org/pkg/http", "v1.0.0")
+		if !errors.Is(err, ErrRequestBudgetExceeded) {
+			t.Errorf("got error %v, want ErrRequestBudgetExceeded", err)
+		}
+		if nRequests != 2 {
+			t.Errorf("got %d requests, want 2", nRequests)
+		}
+
+		// The budget is per call.
+		client.opts.MaxRequests = 3
+		nRequests = 0
+		if _, err := ModuleInfo(context.Background(), client, "alice.org/pkg/http", "v1.0.0"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ModuleInfo(context.Background(), client, "alice.org/pkg/http", "v1.0.0"); err != nil {
+			t.Fatal(err)
+		}
+		if nRequests != 6 {
+			t.Errorf("got %d requests, want 6", nRequests)
+		}
+	})
+	t.Run("redirects", func(t *testing.T) {
+		var nRequests int
+		client := NewClientWithOptions(testTimeout, Options{MaxRedirects: 2})
+		client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			nRequests++
+			h := http.Header{}
+			h.Set("Location", fmt.Sprintf("/loop%d", nRequests))
+			return &http.Response{StatusCode: http.StatusFound, Header: h, Body: http.NoBody, Request: r}, nil
+		})
+		if _, err := client.doURL(context.Background(), "GET", "https://example.com/loop", true); err == nil {
+			t.Fatal("got nil error, want redirect error")
+		}
+		if nRequests != 3 {
+			t.Errorf("got %d requests, want 3", nRequests)
+		}
+	})
+}
+
+func TestRawLineRangeURL(t *testing.T) {
+	for _, test := range []struct {
+		desc       string
+		info       *Info
+		start, end int
+		want       string
+	}{
+		{"github", NewGitHubInfo("https://github.com/a/b", "sub", "v1.0.0"), 3, 7,
+			"https://raw.githubusercontent.com/a/b/v1.0.0/sub/f.go#L3-L7"},
+		{"github single line", NewGitHubInfo("https://github.com/a/b", "", "v1.0.0"), 3, 3,
+			"https://raw.githubusercontent.com/a/b/v1.0.0/f.go#L3-L3"},
+		{"github bad range", NewGitHubInfo("https://github.com/a/b", "", "v1.0.0"), 7, 3,
+			"https://raw.githubusercontent.com/a/b/v1.0.0/f.go"},
+		{"github no lines", NewGitHubInfo("https://github.com/a/b", "", "v1.0.0"), 0, 0,
+			"https://raw.githubusercontent.com/a/b/v1.0.0/f.go"},
+		{"gitlab", NewGitLabInfo("https://gitlab.com/a/b", "", "v1.0.0"), 3, 7,
+			"https://gitlab.com/a/b/raw/v1.0.0/f.go"},
+	} {
+		if got := test.info.RawLineRangeURL("f.go", test.start, test.end); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestReadmeURL(t *testing.T) {
+	for _, test := range []struct {
+		desc      string
+		templates urlTemplates
+		dir       string
+		want      string
+	}{
+		{"github", githubURLTemplates, "", "https://host.com/a/b/tree/v1.0.0#readme"},
+		{"github dir", githubURLTemplates, "c", "https://host.com/a/b/tree/v1.0.0/c#readme"},
+		{"gitlab", gitlabURLTemplates, "c", "https://host.com/a/b/tree/v1.0.0/c"},
+		{"bitbucket", bitbucketURLTemplates, "c", "https://host.com/a/b/src/v1.0.0/c"},
+		{"gitea", giteaURLTemplates, "c", "https://host.com/a/b/src/commit/v1.0.0/c"},
+		{"none", urlTemplates{}, "c", ""},
+	} {
+		info := &Info{repoURL: "https://host.com/a/b", commit: "v1.0.0", templates: test.templates}
+		if got := info.ReadmeURL(test.dir); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestInfoAtCommit(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	client := NewClient(testTimeout)
+	client.httpClient.Transport = testTransport(testWeb)
+	for _, test := range []struct {
+		modulePath, want string
+	}{
+		{"github.com/a/b", "https://github.com/a/b/blob/" + sha + "/f.go"},
+		{"github.com/a/b/sub", "https://github.com/a/b/blob/" + sha + "/sub/f.go"},
+		{"alice.org/pkg/sub", "https://github.com/alice/pkg/blob/" + sha + "/sub/f.go"},
+		{"std", "https://github.com/golang/go/blob/" + sha + "/src/f.go"},
+	} {
+		info, err := InfoAtCommit(context.Background(), client, test.modulePath, sha)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.FileURL("f.go"); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.modulePath, got, test.want)
+		}
+	}
+	if _, err := InfoAtCommit(context.Background(), client, "github.com/a/b", ""); !errors.Is(err, derrors.InvalidArgument) {
+		t.Errorf("empty commit: got error %v, want InvalidArgument", err)
+	}
+}
+
+func TestOwnerAndName(t *testing.T) {
+	templates := urlTemplates{
+		Directory: "https://example.com/{owner}/{name}/dir/{commit}/{dir}",
+		File:      "https://example.com/{owner}/{name}/file/{commit}/{file}",
+		Issues:    "https://issues.example.com/{owner}-{name}",
+	}
+	for _, test := range []struct {
+		repoURL             string
+		wantDir, wantIssues string
+	}{
+		{"https://github.com/golang/go", "https://example.com/golang/go/dir/v1.0.0/d", "https://issues.example.com/golang-go"},
+		{"https://bitbucket.org/a/b", "https://example.com/a/b/dir/v1.0.0/d", "https://issues.example.com/a-b"},
+		// The pattern for gitlab.com has no owner and name groups, so they
+		// come from the repo URL.
+		{"https://gitlab.com/a/b", "https://example.com/a/b/dir/v1.0.0/d", "https://issues.example.com/a-b"},
+		{"https://gitlab.com/group/sub/b", "https://example.com/group/sub/b/dir/v1.0.0/d", "https://issues.example.com/group/sub-b"},
+		// A repo URL with one path element has no owner.
+		{"https://example.com/b", "", ""},
+	} {
+		info := &Info{repoURL: test.repoURL, commit: "v1.0.0", templates: templates}
+		if got := info.DirectoryURL("d"); got != test.wantDir {
+			t.Errorf("%s: DirectoryURL: got %q, want %q", test.repoURL, got, test.wantDir)
+		}
+		if got := info.IssueTrackerURL(); got != test.wantIssues {
+			t.Errorf("%s: IssueTrackerURL: got %q, want %q", test.repoURL, got, test.wantIssues)
+		}
+	}
+}
+
+func TestCheckTagPrefix(t *testing.T) {
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		status := http.StatusNotFound
+		switch r.URL.String() {
+		case "https://github.com/a/novtags/tree/1.2.3",
+			"https://github.com/a/novtags/tree/sub/1.2.3/sub",
+			"https://github.com/a/vtags/tree/v1.2.3":
+			status = http.StatusOK
+		}
+		return &http.Response{StatusCode: status, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+	})
+	for _, test := range []struct {
+		modulePath, version, wantCommit string
+	}{
+		{"github.com/a/novtags", "v1.2.3", "1.2.3"},
+		{"github.com/a/novtags/sub", "v1.2.3", "sub/1.2.3"},
+		{"github.com/a/vtags", "v1.2.3", "v1.2.3"},
+		// Neither tag exists.
+		{"github.com/a/notags", "v1.2.3", "v1.2.3"},
+		{"github.com/a/novtags", "v0.0.0-20200101000000-abcdef123456", "abcdef123456"},
+	} {
+		client := NewClientWithOptions(testTimeout, Options{CheckTagPrefix: true})
+		client.httpClient.Transport = transport
+		info, err := ModuleInfo(context.Background(), client, test.modulePath, test.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.commit != test.wantCommit {
+			t.Errorf("%s@%s: got commit %q, want %q", test.modulePath, test.version, info.commit, test.wantCommit)
+		}
+	}
+}
+
+// TestRetractedVersions checks that versions that are retracted, or that
+// exist only to retract others, resolve like any others: their tags exist.
+func TestRetractedVersions(t *testing.T) {
+	var requests []string
+	client := NewClientWithOptions(testTimeout, Options{CheckTagPrefix: true})
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requests = append(requests, r.URL.String())
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+	})
+	for _, test := range []struct {
+		modulePath, version, want string
+	}{
+		// A version retracted by a later one.
+		{"github.com/a/b", "v1.0.0", "https://github.com/a/b/blob/v1.0.0/f.go"},
+		// A version that only retracts itself, or others.
+		{"github.com/a/b", "v1.0.1", "https://github.com/a/b/blob/v1.0.1/f.go"},
+		{"github.com/a/b/sub/v2", "v2.0.1", "https://github.com/a/b/blob/sub/v2.0.1/sub/v2/f.go"},
+	} {
+		info, err := ModuleInfo(context.Background(), client, test.modulePath, test.version)
+		if err != nil {
+			t.Fatalf("%s@%s: %v", test.modulePath, test.version, err)
+		}
+		if got := info.FileURL("f.go"); got != test.want {
+			t.Errorf("%s@%s: got %q, want %q", test.modulePath, test.version, got, test.want)
+		}
+	}
+	// The only requests are to check the tags, and the directory of the v2
+	// module; nothing looks for retractions.
+	want := []string{
+		"https://github.com/a/b/tree/v1.0.0",
+		"https://github.com/a/b/tree/v1.0.1",
+		"https://github.com/a/b/blob/sub/v2.0.1/sub/v2/go.mod",
+		"https://github.com/a/b/tree/sub/v2.0.1/sub/v2",
+	}
+	if !cmp.Equal(requests, want) {
+		t.Errorf("got requests %v, want %v", requests, want)
+	}
+}
+
+func TestStdlibCommands(t *testing.T) {
+	for _, test := range []struct {
+		version, dir, file string
+		wantDir, wantFile  string
+	}{
+		{
+			"v1.15.2", "cmd/go/internal/modfetch", "cmd/go/internal/modfetch/fetch.go",
+			"https://github.com/golang/go/tree/go1.15.2/src/cmd/go/internal/modfetch",
+			"https://github.com/golang/go/blob/go1.15.2/src/cmd/go/internal/modfetch/fetch.go",
+		},
+		{
+			"v1.4.0", "cmd/go", "cmd/go/get.go",
+			"https://github.com/golang/go/tree/go1.4/src/cmd/go",
+			"https://github.com/golang/go/blob/go1.4/src/cmd/go/get.go",
+		},
+		{
+			// Before Go 1.4, commands were not under src/pkg.
+			"v1.3.3", "cmd/go", "cmd/go/get.go",
+			"https://github.com/golang/go/tree/go1.3.3/src/cmd/go",
+			"https://github.com/golang/go/blob/go1.3.3/src/cmd/go/get.go",
+		},
+		{
+			// But packages were.
+			"v1.3.3", "cmdline", "cmdline/x.go",
+			"https://github.com/golang/go/tree/go1.3.3/src/pkg/cmdline",
+			"https://github.com/golang/go/blob/go1.3.3/src/pkg/cmdline/x.go",
+		},
+	} {
+		info, err := ModuleInfo(context.Background(), nil, "std", test.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.DirectoryURL(test.dir); got != test.wantDir {
+			t.Errorf("%s: DirectoryURL: got %q, want %q", test.version, got, test.wantDir)
+		}
+		if got := info.FileURL(test.file); got != test.wantFile {
+			t.Errorf("%s: FileURL: got %q, want %q", test.version, got, test.wantFile)
+		}
+	}
+}
+
+func TestWikiURL(t *testing.T) {
+	for _, test := range []struct {
+		desc      string
+		templates urlTemplates
+		want      string
+	}{
+		{"github", githubURLTemplates, "https://host.com/a/b/wiki"},
+		{"gitlab", gitlabURLTemplates, "https://host.com/a/b/-/wikis/home"},
+		{"bitbucket", bitbucketURLTemplates, "https://host.com/a/b/wiki"},
+		{"unknown", urlTemplates{}, ""},
+	} {
+		info := &Info{repoURL: "https://host.com/a/b", templates: test.templates}
+		if got := info.WikiURL(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestFeedURLs(t *testing.T) {
+	for _, test := range []struct {
+		desc                   string
+		templates              urlTemplates
+		wantReleases, wantTags string
+	}{
+		{"github", githubURLTemplates, "https://host.com/a/b/releases.atom", "https://host.com/a/b/tags.atom"},
+		{"gitlab", gitlabURLTemplates, "", ""},
+		{"unknown", urlTemplates{}, "", ""},
+	} {
+		info := &Info{repoURL: "https://host.com/a/b", templates: test.templates}
+		if got := info.ReleasesFeedURL(); got != test.wantReleases {
+			t.Errorf("%s: ReleasesFeedURL: got %q, want %q", test.desc, got, test.wantReleases)
+		}
+		if got := info.TagsFeedURL(); got != test.wantTags {
+			t.Errorf("%s: TagsFeedURL: got %q, want %q", test.desc, got, test.wantTags)
+		}
+	}
+}
+
+func TestActionsURL(t *testing.T) {
+	for _, test := range []struct {
+		info *Info
+		want string
+	}{
+		{NewGitHubInfo("https://github.com/a/b", "", "v1.0.0"), "https://github.com/a/b/actions"},
+		{NewGitLabInfo("https://gitlab.com/a/b", "", "v1.0.0"), ""},
+	} {
+		if got := test.info.ActionsURL(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.info.RepoURL(), got, test.want)
+		}
+	}
+}
+
+func TestGoImportOnly(t *testing.T) {
+	client := NewClient(testTimeout)
+	client.httpClient.Transport = testTransport(testWeb)
+	for _, test := range []struct {
+		modulePath, want string
+	}{
+		{"alice.org/pkg", "https://github.com/alice/pkg/blob/v1.0.0/a/b.go"},
+		{"grace.org/ssh", "https://github.com/grace/ssh/blob/v1.0.0/a/b.go"},
+		{"grace.org/git", "https://gitlab.com/grace/git/blob/v1.0.0/a/b.go"},
+	} {
+		info, err := ModuleInfo(context.Background(), client, test.modulePath, "v1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.FileURL("a/b.go"); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.modulePath, got, test.want)
+		}
+	}
+}
+
+func TestFileURLAt(t *testing.T) {
+	info := NewGitHubInfo("https://github.com/a/b", "sub", "sub/v1.2.0")
+	for _, test := range []struct {
+		commit, want string
+	}{
+		{"sub/v1.0.0", "https://github.com/a/b/blob/sub/v1.0.0/sub/f.go"},
+		{"0123456789ab", "https://github.com/a/b/blob/0123456789ab/sub/f.go"},
+	} {
+		if got := info.FileURLAt(test.commit, "f.go"); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.commit, got, test.want)
+		}
+	}
+	// The Info is unchanged.
+	if got, want := info.FileURL("f.go"), "https://github.com/a/b/blob/sub/v1.2.0/sub/f.go"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGooglesource(t *testing.T) {
+	for _, test := range []struct {
+		modulePath, wantRepo, wantDir, wantFile string
+	}{
+		{
+			"code.googlesource.com/gocloud",
+			"https://code.googlesource.com/gocloud",
+			"https://code.googlesource.com/gocloud/+/v1.0.0/storage",
+			"https://code.googlesource.com/gocloud/+/v1.0.0/storage/writer.go",
+		},
+		{
+			"chromium.googlesource.com/infra/luci/luci-go.git/grpc",
+			"https://chromium.googlesource.com/infra/luci/luci-go",
+			"https://chromium.googlesource.com/infra/luci/luci-go/+/grpc/v1.0.0/grpc/storage",
+			"https://chromium.googlesource.com/infra/luci/luci-go/+/grpc/v1.0.0/grpc/storage/writer.go",
+		},
+	} {
+		info, err := ModuleInfo(context.Background(), nil, test.modulePath, "v1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.RepoURL(); got != test.wantRepo {
+			t.Errorf("%s: RepoURL: got %q, want %q", test.modulePath, got, test.wantRepo)
+		}
+		if got := info.DirectoryURL("storage"); got != test.wantDir {
+			t.Errorf("%s: DirectoryURL: got %q, want %q", test.modulePath, got, test.wantDir)
+		}
+		if got := info.FileURL("storage/writer.go"); got != test.wantFile {
+			t.Errorf("%s: FileURL: got %q, want %q", test.modulePath, got, test.wantFile)
+		}
+	}
+}
+
+func TestMixedCaseHost(t *testing.T) {
+	for _, test := range []struct {
+		modulePath, want string
+	}{
+		{"GitHub.com/Owner/Repo", "https://github.com/Owner/Repo/blob/v1.0.0/f.go"},
+		{"BITBUCKET.ORG/a/B/sub", "https://bitbucket.org/a/B/src/sub/v1.0.0/sub/f.go"},
+	} {
+		info, err := ModuleInfo(context.Background(), nil, test.modulePath, "v1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.FileURL("f.go"); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.modulePath, got, test.want)
+		}
+	}
+}
+
+func TestInternalDirectories(t *testing.T) {
+	// "internal" path elements are not special.
+	for _, test := range []struct {
+		modulePath, wantDir, wantFile string
+	}{
+		{
+			"github.com/a/b",
+			"https://github.com/a/b/tree/v1.0.0/internal/x",
+			"https://github.com/a/b/blob/v1.0.0/internal/x/x.go",
+		},
+		{
+			"github.com/a/b/internal/m",
+			"https://github.com/a/b/tree/internal/m/v1.0.0/internal/m/internal/x",
+			"https://github.com/a/b/blob/internal/m/v1.0.0/internal/m/internal/x/x.go",
+		},
+	} {
+		info, err := ModuleInfo(context.Background(), nil, test.modulePath, "v1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.DirectoryURL("internal/x"); got != test.wantDir {
+			t.Errorf("%s: DirectoryURL: got %q, want %q", test.modulePath, got, test.wantDir)
+		}
+		if got := info.FileURL("internal/x/x.go"); got != test.wantFile {
+			t.Errorf("%s: FileURL: got %q, want %q", test.modulePath, got, test.wantFile)
+		}
+	}
+}
+
+func TestGerritChangeURL(t *testing.T) {
+	for _, test := range []struct {
+		repoURL, change, want string
+	}{
+		{"https://go.googlesource.com/image", "12345", "https://go-review.googlesource.com/c/image/+/12345"},
+		{"https://chromium.googlesource.com/infra/luci/luci-go", "678", "https://chromium-review.googlesource.com/c/infra/luci/luci-go/+/678"},
+		{"https://go.googlesource.com/image", "I0123abc", ""},
+		{"https://go.googlesource.com/image", "-1", ""},
+		{"https://github.com/a/b", "12345", ""},
+	} {
+		info := &Info{repoURL: test.repoURL}
+		if got := info.GerritChangeURL(test.change); got != test.want {
+			t.Errorf("%s, %s: got %q, want %q", test.repoURL, test.change, got, test.want)
+		}
+	}
+}
+
+func TestCandidateMatches(t *testing.T) {
+	got := CandidateMatches("github.com/a/b.git/c")
+	want := []MatchDebug{
+		{
+			Pattern:      patterns[0].re.String(),
+			Repo:         "github.com/a/b.git",
+			RelativePath: "c",
+			Kind:         "github",
+		},
+		{
+			Pattern:      patterns[len(patterns)-1].re.String(),
+			Repo:         "github.com/a/b",
+			RelativePath: "c",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+	if got := CandidateMatches("example.com/a/b"); got != nil {
+		t.Errorf("got %+v, want nil", got)
+	}
+}
+
+func TestModuleInfoFromMeta(t *testing.T) {
+	meta := &SourceMeta{
+		RepoRootPrefix: "example.com/pkg",
+		RepoURL:        "https://github.com/example/pkg",
+		VCS:            "git",
+	}
+	info, err := ModuleInfoFromMeta(context.Background(), meta, "example.com/pkg/sub", "v1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Info{
+		repoURL:   "https://github.com/example/pkg",
+		moduleDir: "sub",
+		commit:    "sub/v1.2.3",
+		templates: githubURLTemplates,
+	}
+	if diff := cmp.Diff(want, info, cmp.AllowUnexported(Info{}, urlTemplates{})); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	// Relative go-source templates are made absolute without changing meta.
+	meta = &SourceMeta{
+		RepoRootPrefix: "example.com/hg",
+		RepoURL:        "https://hg.example.com/hg",
+		VCS:            "hg",
+		DirTemplate:    "/file/tip{/dir}",
+		FileTemplate:   "/file/tip{/dir}/{file}#l{line}",
+	}
+	info, err = ModuleInfoFromMeta(context.Background(), meta, "example.com/hg", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.LineURL("f.go", 2), "https://hg.example.com/hg/file/v1.0.0/f.go#l2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if meta.DirTemplate != "/file/tip{/dir}" {
+		t.Errorf("meta was modified: %+v", meta)
+	}
+
+	for _, m := range []*SourceMeta{nil, {RepoRootPrefix: "example.com/other"}} {
+		if _, err := ModuleInfoFromMeta(context.Background(), m, "example.com/pkg", "v1.0.0"); !errors.Is(err, derrors.InvalidArgument) {
+			t.Errorf("%+v: got error %v, want InvalidArgument", m, err)
+		}
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	info := NewGitHubInfo("https://github.com/a/b", "my dir", "v1.0.0")
+	for _, test := range []struct {
+		desc, got, want string
+	}{
+		{"DirectoryURL", info.DirectoryURL("x#y"), "https://github.com/a/b/tree/v1.0.0/my%20dir/x%23y"},
+		{"FileURL", info.FileURL("c d/f#1.go"), "https://github.com/a/b/blob/v1.0.0/my%20dir/c%20d/f%231.go"},
+		{"LineURL", info.LineURL("f (1).go", 3), "https://github.com/a/b/blob/v1.0.0/my%20dir/f%20%281%29.go#L3"},
+		{"RawURL", info.RawURL("f?.go"), "https://raw.githubusercontent.com/a/b/v1.0.0/my%20dir/f%3F.go"},
+		// Files in testdata directories often have unusual names.
+		{"testdata FileURL", info.FileURL("testdata/100%.txt"), "https://github.com/a/b/blob/v1.0.0/my%20dir/testdata/100%25.txt"},
+		{"testdata FileURL ?", info.FileURL("testdata/a?b%3F.go"), "https://github.com/a/b/blob/v1.0.0/my%20dir/testdata/a%3Fb%253F.go"},
+		{"testdata LineURL", info.LineURL("testdata/x?%.go", 2), "https://github.com/a/b/blob/v1.0.0/my%20dir/testdata/x%3F%25.go#L2"},
+		{"testdata RawURL", info.RawURL("testdata/50%?.txt"), "https://raw.githubusercontent.com/a/b/v1.0.0/my%20dir/testdata/50%25%3F.txt"},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, test.got, test.want)
+		}
+	}
+}
+
+func TestZeroBasedLineURL(t *testing.T) {
+	info := NewGitHubInfo("https://github.com/a/b", "", "v1.0.0")
+	for _, test := range []struct {
+		line int
+		want string
+	}{
+		{0, "https://github.com/a/b/blob/v1.0.0/f.go#L1"},
+		{9, "https://github.com/a/b/blob/v1.0.0/f.go#L10"},
+		{-1, "https://github.com/a/b/blob/v1.0.0/f.go"},
+	} {
+		if got := info.ZeroBasedLineURL("f.go", test.line); got != test.want {
+			t.Errorf("%d: got %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestStdAndCmdModules(t *testing.T) {
+	for _, test := range []struct {
+		modulePath, version, file, want string
+	}{
+		{"std", "v1.15.2", "net/http/server.go", "https://github.com/golang/go/blob/go1.15.2/src/net/http/server.go"},
+		{"cmd", "v1.15.2", "go/internal/modfetch/fetch.go", "https://github.com/golang/go/blob/go1.15.2/src/cmd/go/internal/modfetch/fetch.go"},
+		{"cmd", "v1.3.3", "go/get.go", "https://github.com/golang/go/blob/go1.3.3/src/cmd/go/get.go"},
+	} {
+		info, err := ModuleInfo(context.Background(), nil, test.modulePath, test.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.FileURL(test.file); got != test.want {
+			t.Errorf("%s@%s: got %q, want %q", test.modulePath, test.version, got, test.want)
+		}
+	}
+}
+
+func TestBranchNameVersion(t *testing.T) {
+	info, err := ModuleInfo(context.Background(), nil, "github.com/a/b/sub", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.FileURL("f.go"), "https://github.com/a/b/blob/main/sub/f.go"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSymlinkFileURL(t *testing.T) {
+	info := NewGitHubInfo("https://github.com/a/b", "sub", "v1.0.0")
+	for _, test := range []struct {
+		pathname, target, want string
+	}{
+		{"link.go", "real.go", "https://github.com/a/b/blob/v1.0.0/sub/real.go"},
+		{"x/link.go", "../y/real.go", "https://github.com/a/b/blob/v1.0.0/sub/y/real.go"},
+		// Outside the module, but inside the repo.
+		{"LICENSE", "../LICENSE", "https://github.com/a/b/blob/v1.0.0/LICENSE"},
+		// Outside the repo.
+		{"link.go", "../../real.go", "https://github.com/a/b/blob/v1.0.0/sub/link.go"},
+		{"link.go", "/etc/passwd", "https://github.com/a/b/blob/v1.0.0/sub/link.go"},
+	} {
+		if got := info.SymlinkFileURL(test.pathname, test.target); got != test.want {
+			t.Errorf("%s -> %s: got %q, want %q", test.pathname, test.target, got, test.want)
+		}
+	}
+}
+
+func TestSourceHut(t *testing.T) {
+	info, err := ModuleInfo(context.Background(), nil, "git.sr.ht/~alice/repo/sub", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const repo = "https://git.sr.ht/~alice/repo"
+	for _, test := range []struct {
+		desc, got, want string
+	}{
+		{"RepoURL", info.RepoURL(), repo},
+		{"DirectoryURL", info.DirectoryURL("d"), repo + "/tree/sub/v1.0.0/item/sub/d"},
+		{"FileURL", info.FileURL("f.go"), repo + "/tree/sub/v1.0.0/item/sub/f.go"},
+		{"LineURL", info.LineURL("f.go", 3), repo + "/tree/sub/v1.0.0/item/sub/f.go#L3"},
+		{"RawURL", info.RawURL("f.go"), repo + "/blob/sub/v1.0.0/sub/f.go"},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, test.got, test.want)
+		}
+	}
+}
+
+func TestIncompatibleNestedModule(t *testing.T) {
+	for _, test := range []struct {
+		modulePath, version, want string
+	}{
+		{"github.com/x/y/sub", "v2.0.0+incompatible", "https://github.com/x/y/blob/sub/v2.0.0/sub/f.go"},
+		{"github.com/x/y/sub", "v2.0.1-0.20200101000000-abcdef123456+incompatible", "https://github.com/x/y/blob/abcdef123456/sub/f.go"},
+		{"github.com/x/y", "v3.1.0+incompatible", "https://github.com/x/y/blob/v3.1.0/f.go"},
+	} {
+		info, err := ModuleInfo(context.Background(), nil, test.modulePath, test.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.FileURL("f.go"); got != test.want {
+			t.Errorf("%s@%s: got %q, want %q", test.modulePath, test.version, got, test.want)
+		}
+	}
+}
+
+func TestNilClient(t *testing.T) {
+	info, err := ModuleInfo(context.Background(), nil, "github.com/a/b", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.RepoURL(), "https://github.com/a/b"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := ModuleInfo(context.Background(), nil, "vanity.example.com/pkg", "v1.0.0"); !errors.Is(err, ErrNoSourceInfo) {
+		t.Errorf("vanity path: got error %v, want ErrNoSourceInfo", err)
+	}
+}
+
+func TestAddPhabricatorRepo(t *testing.T) {
+	savePatterns(t)
+	AddPhabricatorRepo("phab.example.com", "tools")
+
+	info, err := ModuleInfoFromMeta(context.Background(), &SourceMeta{
+		RepoRootPrefix: "example.com/tools",
+		RepoURL:        "https://phab.example.com/source/tools.git",
+		VCS:            "git",
+	}, "example.com/tools/sub", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const repo = "https://phab.example.com/source/tools"
+	for _, test := range []struct {
+		desc, got, want string
+	}{
+		{"RepoURL", info.RepoURL(), repo},
+		{"DirectoryURL", info.DirectoryURL("d"), repo + "/browse/sub/v1.0.0/sub/d"},
+		{"FileURL", info.FileURL("f.go"), repo + "/browse/sub/v1.0.0/sub/f.go"},
+		{"LineURL", info.LineURL("f.go", 12), repo + "/browse/sub/v1.0.0/sub/f.go$12"},
+		{"LineRangeURL", info.LineRangeURL("f.go", 12, 15), repo + "/browse/sub/v1.0.0/sub/f.go$12-15"},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, test.got, test.want)
+		}
+	}
+}
+
+func TestEmptyCommit(t *testing.T) {
+	for _, test := range []struct {
+		desc   string
+		client *Client
+		want   string
+	}{
+		{"default", nil, "https://github.com/a/b/tree/HEAD/sub/d"},
+		{"configured", NewClientWithOptions(testTimeout, Options{DefaultRef: "main"}), "https://github.com/a/b/tree/main/sub/d"},
+	} {
+		info, err := ModuleInfo(context.Background(), test.client, "github.com/a/b/sub", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.DirectoryURL("d"); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, got, test.want)
+		}
+	}
+
+	// Info derived from meta tags falls back to a ref only when the repo's
+	// kind is known.
+	ctx := WithOptions(context.Background(), Options{DefaultRef: "main"})
+	for _, test := range []struct {
+		desc string
+		meta SourceMeta
+		want string
+	}{
+		{
+			"git",
+			SourceMeta{RepoRootPrefix: "example.com/b", RepoURL: "https://github.com/a/b", VCS: "git"},
+			"https://github.com/a/b/tree/main/sub/d",
+		},
+		{
+			"hg",
+			SourceMeta{
+				RepoRootPrefix: "example.com/b",
+				RepoURL:        "https://hg.example.com/b",
+				VCS:            "hg",
+				DirTemplate:    "https://hg.example.com/b/file/default{/dir}",
+				FileTemplate:   "https://hg.example.com/b/file/default{/dir}/{file}#l{line}",
+			},
+			"https://hg.example.com/b/file/tip/sub/d",
+		},
+		{
+			"unknown",
+			SourceMeta{
+				RepoRootPrefix: "example.com/b",
+				RepoURL:        "https://code.example.com/b",
+				VCS:            "svn",
+			},
+			"",
+		},
+	} {
+		info, err := ModuleInfoFromMeta(ctx, &test.meta, "example.com/b/sub", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.DirectoryURL("d"); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, got, test.want)
+		}
+		if test.want == "" && info.commit != "" {
+			t.Errorf("%s: got commit %q, want none", test.desc, info.commit)
+		}
+	}
+}
+
+func TestShortCommits(t *testing.T) {
+	const commit = "3a9541ec99740f0da4e2e5b1e4f13b1c2a6d7e8f"
+	client := NewClientWithOptions(testTimeout, Options{ShortCommits: true})
+	for _, test := range []struct {
+		modulePath, commit, want string
+	}{
+		{"github.com/a/b", commit, "https://github.com/a/b/blob/3a9541ec9974/f.go"},
+		{"go.googlesource.com/tools", commit, "https://go.googlesource.com/tools/+/" + commit + "/f.go"},
+		// Refs that aren't full commit IDs are unchanged.
+		{"github.com/a/b", "3a9541ec9974", "https://github.com/a/b/blob/3a9541ec9974/f.go"},
+		{"github.com/a/b", "main", "https://github.com/a/b/blob/main/f.go"},
+	} {
+		info, err := InfoAtCommit(context.Background(), client, test.modulePath, test.commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.FileURL("f.go"); got != test.want {
+			t.Errorf("%s@%s: got %q, want %q", test.modulePath, test.commit, got, test.want)
+		}
+	}
+}
+
+func TestRootModuleURLs(t *testing.T) {
+	client := NewClient(testTimeout)
+	client.httpClient.Transport = testTransport(testWeb)
+	for _, test := range []struct {
+		modulePath                     string
+		wantRepo, wantModule, wantFile string
+	}{
+		// A repo on a host with the generic go command syntax. There are no
+		// URL templates for it, so only the repo URL is known.
+		{"example.org/repo.git", "https://example.org/repo", "", ""},
+		// A Mercurial repo whose URL templates come from its hgweb go-source tag.
+		{"carol.org/pkg", "https://hg.carol.org/pkg", "https://hg.carol.org/pkg/file/v1.2.3", "https://hg.carol.org/pkg/file/v1.2.3/f.go"},
+	} {
+		info, err := ModuleInfo(context.Background(), client, test.modulePath, "v1.2.3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.RepoURL(); got != test.wantRepo {
+			t.Errorf("%s: RepoURL: got %q, want %q", test.modulePath, got, test.wantRepo)
+		}
+		if got := info.ModuleURL(); got != test.wantModule {
+			t.Errorf("%s: ModuleURL: got %q, want %q", test.modulePath, got, test.wantModule)
+		}
+		if got := info.FileURL("f.go"); got != test.wantFile {
+			t.Errorf("%s: FileURL: got %q, want %q", test.modulePath, got, test.wantFile)
+		}
+	}
+}
+
+func TestModuleRelativePaths(t *testing.T) {
+	info := NewGitHubInfo("https://github.com/a/b", "sub", "sub/v1.0.0")
+	for _, test := range []struct {
+		pathname, want string
+		wantErr        bool
+	}{
+		{"f.go", "https://github.com/a/b/blob/sub/v1.0.0/sub/f.go", false},
+		{"subdir/f.go", "https://github.com/a/b/blob/sub/v1.0.0/sub/subdir/f.go", false},
+		// A path that includes the module's directory by mistake has it twice,
+		// as it would for a subdirectory of the module named "sub". The check
+		// reports it.
+		{"sub/f.go", "https://github.com/a/b/blob/sub/v1.0.0/sub/sub/f.go", true},
+		{"sub", "https://github.com/a/b/blob/sub/v1.0.0/sub/sub", true},
+	} {
+		err := info.CheckRelativePath(test.pathname)
+		if test.wantErr {
+			if !errors.Is(err, derrors.InvalidArgument) {
+				t.Errorf("CheckRelativePath(%q): got %v, want InvalidArgument", test.pathname, err)
+			}
+		} else if err != nil {
+			t.Errorf("CheckRelativePath(%q): %v", test.pathname, err)
+		}
+		if got := info.FileURL(test.pathname); got != test.want {
+			t.Errorf("FileURL(%q) = %q, want %q", test.pathname, got, test.want)
+		}
+	}
+	// Any path is relative to the module of a repo root.
+	root := NewGitHubInfo("https://github.com/a/b", "", "v1.0.0")
+	if err := root.CheckRelativePath("sub/f.go"); err != nil {
+		t.Errorf("repo root: CheckRelativePath: %v", err)
+	}
+}
+
+func TestHTTPFallback(t *testing.T) {
+	client := NewClient(testTimeout)
+	client.httpClient.Transport = testTransport(testWeb)
+	// The meta tags of alice.org/pkg/http are only served over http.
+	info, err := ModuleInfo(context.Background(), client, "alice.org/pkg/http", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.RepoURL(), "https://github.com/alice/pkg"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestInsecure(t *testing.T) {
+	for _, test := range []struct {
+		insecure             bool
+		wantHTTP, wantSource string
+	}{
+		{false, "https://github.com/alice/pkg", "https://alice.org/pkg"},
+		{true, "https://github.com/alice/pkg", "http://alice.org/pkg"},
+	} {
+		client := NewClientWithOptions(testTimeout, Options{Insecure: test.insecure})
+		client.httpClient.Transport = testTransport(testWeb)
+		// The meta tags of alice.org/pkg/http are only served over http,
+		// which every client falls back to.
+		info, err := ModuleInfo(context.Background(), client, "alice.org/pkg/http", "v1.0.0")
+		if err != nil {
+			t.Errorf("insecure=%t: %v", test.insecure, err)
+		} else if got := info.RepoURL(); got != test.wantHTTP {
+			t.Errorf("insecure=%t: got %q, want %q", test.insecure, got, test.wantHTTP)
+		}
+		// The repo URL of alice.org/pkg/source begins with "http://".
+		info, err = ModuleInfo(context.Background(), client, "alice.org/pkg/source", "v1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.RepoURL(); got != test.wantSource {
+			t.Errorf("insecure=%t: got %q, want %q", test.insecure, got, test.wantSource)
+		}
+	}
+}
+
+func TestAddCgitHost(t *testing.T) {
+	savePatterns(t)
+	AddCgitHost("git.kernel.org")
+
+	info, err := ModuleInfo(context.Background(), nil, "git.kernel.org/pub/scm/a/b.git/sub", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const repo = "https://git.kernel.org/pub/scm/a/b"
+	for _, test := range []struct {
+		desc, got, want string
+	}{
+		{"RepoURL", info.RepoURL(), repo},
+		{"DirectoryURL", info.DirectoryURL("d"), repo + "/tree/sub/d?h=sub/v1.0.0"},
+		{"FileURL", info.FileURL("f.go"), repo + "/tree/sub/f.go?h=sub/v1.0.0"},
+		{"LineURL", info.LineURL("f.go", 12), repo + "/tree/sub/f.go?h=sub/v1.0.0#n12"},
+		{"RawURL", info.RawURL("f.go"), repo + "/plain/sub/f.go?h=sub/v1.0.0"},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, test.got, test.want)
+		}
+	}
+}
+
+func TestRepoHint(t *testing.T) {
+	client := NewClientWithOptions(testTimeout, Options{
+		RepoHint: func(ctx context.Context, modulePath string) (*SourceMeta, error) {
+			if strings.HasPrefix(modulePath, "mirror.example.com/bad") {
+				return &SourceMeta{
+					RepoRootPrefix: "mirror.example.com/x",
+					RepoURL:        "https://github.com/x/y",
+					VCS:            "git",
+				}, nil
+			}
+			if !strings.HasPrefix(modulePath, "mirror.example.com/") {
+				return nil, nil
+			}
+			return &SourceMeta{
+				RepoRootPrefix: "mirror.example.com/x",
+				RepoURL:        "https://github.com/x/y",
+				VCS:            "git",
+			}, nil
+		},
+	})
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("unexpected request for %s", r.URL)
+	})
+	info, err := ModuleInfo(context.Background(), client, "mirror.example.com/x/sub", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.FileURL("f.go"), "https://github.com/x/y/blob/sub/v1.0.0/sub/f.go"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Without a hint, meta tags are fetched.
+	if _, err := ModuleInfo(context.Background(), client, "other.example.com/x", "v1.0.0"); err == nil {
+		t.Error("got nil error, want one from fetching meta tags")
+	}
+	// A hint whose repo root prefix does not match is rejected.
+	if _, err := ModuleInfo(context.Background(), client, "mirror.example.com/bad", "v1.0.0"); !errors.Is(err, derrors.InvalidArgument) {
+		t.Errorf("got error %v, want InvalidArgument", err)
+	}
+	// Hints are not used for denied hosts.
+	client.opts.DeniedHosts = []string{"mirror.example.com"}
+	if _, err := ModuleInfo(context.Background(), client, "mirror.example.com/x/sub", "v1.0.0"); !errors.Is(err, ErrNoSourceInfo) {
+		t.Errorf("got error %v, want ErrNoSourceInfo", err)
+	}
+}
+
+func TestGitHubSlug(t *testing.T) {
+	for _, test := range []struct {
+		info   *Info
+		want   string
+		wantOK bool
+	}{
+		{NewGitHubInfo("https://github.com/a/b", "sub", "v1.0.0"), "a/b", true},
+		{NewGitLabInfo("https://gitlab.com/a/b", "", "v1.0.0"), "", false},
+		// Apache repos use the GitHub templates, but are not on GitHub.
+		{&Info{repoURL: "https://git.apache.org/thrift", templates: githubURLTemplates}, "", false},
+		{nil, "", false},
+	} {
+		got, ok := test.info.GitHubSlug()
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("%s: got (%q, %t), want (%q, %t)", test.info.RepoURL(), got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestBrowseHosts(t *testing.T) {
+	savePatterns(t)
+	AddGiteaHost("git.internal")
+
+	client := NewClientWithOptions(testTimeout, Options{
+		BrowseHosts: map[string]string{"git.internal": "browse.internal"},
+	})
+	for _, test := range []struct {
+		modulePath, wantRepo, wantFile string
+	}{
+		{"git.internal/a/b", "https://browse.internal/a/b", "https://browse.internal/a/b/src/commit/v1.0.0/f.go"},
+		// Other hosts are unchanged.
+		{"github.com/a/b", "https://github.com/a/b", "https://github.com/a/b/blob/v1.0.0/f.go"},
+	} {
+		info, err := ModuleInfo(context.Background(), client, test.modulePath, "v1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.RepoURL(); got != test.wantRepo {
+			t.Errorf("%s: RepoURL: got %q, want %q", test.modulePath, got, test.wantRepo)
+		}
+		if got := info.FileURL("f.go"); got != test.wantFile {
+			t.Errorf("%s: FileURL: got %q, want %q", test.modulePath, got, test.wantFile)
+		}
+	}
+}
+
+func TestGiteaVanityPath(t *testing.T) {
+	savePatterns(t)
+
+	client := NewClient(testTimeout)
+	client.httpClient.Transport = testTransport(testWeb)
+	// Without the Gitea host, there are no templates.
+	info, err := ModuleInfo(context.Background(), client, "modernc.org/sqlite", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.FileURL("f.go"); got != "" {
+		t.Errorf("got %q, want empty", got)
+	}
+
+	AddGiteaHost("git.modernc.org")
+	info, err = ModuleInfo(context.Background(), client, "modernc.org/sqlite", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.FileURL("f.go"), "https://git.modernc.org/cznic/sqlite/src/commit/v1.0.0/f.go"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCompareInfo(t *testing.T) {
+	for _, test := range []struct {
+		modulePath, from, to string
+		wantFrom, wantTo     string
+		wantURL              string
+	}{
+		{
+			"github.com/a/b", "v1.0.0", "v1.1.0",
+			"v1.0.0", "v1.1.0",
+			"https://github.com/a/b/compare/v1.0.0...v1.1.0",
+		},
+		{
+			"github.com/a/b/sub", "v1.0.0", "v1.1.0-0.20200101000000-abcdef123456",
+			"sub/v1.0.0", "abcdef123456",
+			"https://github.com/a/b/compare/sub/v1.0.0...abcdef123456",
+		},
+	} {
+		info, from, to, err := CompareInfo(context.Background(), nil, test.modulePath, test.from, test.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from != test.wantFrom || to != test.wantTo {
+			t.Errorf("%s: got commits %q, %q, want %q, %q", test.modulePath, from, to, test.wantFrom, test.wantTo)
+		}
+		if got := info.CompareURL(from); got != test.wantURL {
+			t.Errorf("%s: got %q, want %q", test.modulePath, got, test.wantURL)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx := context.Background()
+	var requests []string
+	client := NewClient(testTimeout)
+	client.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requests = append(requests, r.URL.String())
+		h := http.Header{}
+		switch r.URL.Host {
+		case "limited.com":
+			h.Set("Retry-After", "120")
+		case "nowait.com":
+		default:
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+			Status:     "429 Too Many Requests",
+			Header:     h,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	})
+	for _, u := range []string{
+		"https://limited.com/a",
+		"https://limited.com/b", // not requested, because of the Retry-After header
+		"https://nowait.com/a",
+		"https://nowait.com/b",
+	} {
+		if _, err := client.doURL(ctx, "GET", u, true); !errors.Is(err, ErrRateLimited) {
+			t.Errorf("%s: got error %v, want ErrRateLimited", u, err)
+		}
+	}
+	// Other hosts are not affected.
+	if _, err := client.doURL(ctx, "GET", "https://other.com/a", true); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://limited.com/a", "https://nowait.com/a", "https://nowait.com/b", "https://other.com/a"}
+	if !cmp.Equal(requests, want) {
+		t.Errorf("got requests %v, want %v", requests, want)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		in     string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{"0", 0, true},
+		{"Wed, 01 Jan 2020 00:00:30 GMT", 30 * time.Second, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"soon", 0, false},
+	} {
+		got, ok := retryAfter(test.in, now)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("retryAfter(%q) = (%v, %t), want (%v, %t)", test.in, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestLocalInfo(t *testing.T) {
+	info := LocalInfo("/home/me/my mod/")
+	for _, test := range []struct {
+		desc, got, want string
+	}{
+		{"RepoURL", info.RepoURL(), "file:///home/me/my%20mod"},
+		{"ModuleURL", info.ModuleURL(), "file:///home/me/my%20mod"},
+		{"DirectoryURL", info.DirectoryURL("a/b"), "file:///home/me/my%20mod/a/b"},
+		{"FileURL", info.FileURL("a/f#1.go"), "file:///home/me/my%20mod/a/f%231.go"},
+		{"LineURL", info.LineURL("a/f.go", 3), "file:///home/me/my%20mod/a/f.go"},
+		{"RawURL", info.RawURL("a/f.go"), "file:///home/me/my%20mod/a/f.go"},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, test.got, test.want)
+		}
+	}
+}
+
+func TestRef(t *testing.T) {
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	for _, test := range []struct {
+		commit              string
+		wantShort, wantFull string
+	}{
+		{"v1.2.3", "v1.2.3", "refs/tags/v1.2.3"},
+		{"sub/v1.2.3", "sub/v1.2.3", "refs/tags/sub/v1.2.3"},
+		{"1.2.3", "1.2.3", "refs/tags/1.2.3"},
+		{"main", "main", "refs/heads/main"},
+		{"v2", "v2", "refs/heads/v2"},
+		{hash, hash, hash},
+		// Could be a branch or an abbreviated hash.
+		{"abcdef123456", "abcdef123456", ""},
+		{"cafe123", "cafe123", ""},
+		{"HEAD", "HEAD", "HEAD"},
+		{"", "", ""},
+	} {
+		info := NewGitHubInfo("https://github.com/a/b", "", test.commit)
+		if got := info.Ref(ShortRef); got != test.wantShort {
+			t.Errorf("%q: ShortRef: got %q, want %q", test.commit, got, test.wantShort)
+		}
+		if got := info.Ref(FullRef); got != test.wantFull {
+			t.Errorf("%q: FullRef: got %q, want %q", test.commit, got, test.wantFull)
+		}
+	}
+}
+
+func TestRefKind(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		info *Info
+		want string
+	}{
+		{
+			"pseudo-version",
+			mustModuleInfo(t, "github.com/a/b", "v0.0.0-20200101000000-abcdef123456"),
+			"abcdef123456",
+		},
+		{
+			"hex branch",
+			mustModuleInfo(t, "github.com/a/b", "deadbeef"),
+			"refs/heads/deadbeef",
+		},
+		{
+			"short hex branch",
+			mustModuleInfo(t, "github.com/a/b", "cafe123"),
+			"refs/heads/cafe123",
+		},
+		{
+			"major version branch",
+			mustModuleInfo(t, "github.com/a/b", "v2"),
+			"refs/heads/v2",
+		},
+		{
+			"tag",
+			mustModuleInfo(t, "github.com/a/b/sub", "v1.2.3"),
+			"refs/tags/sub/v1.2.3",
+		},
+		{
+			"branch from origin",
+			mustInfoFromOrigin(t, &Origin{URL: "https://github.com/a/b", Ref: "refs/heads/cafe123"}),
+			"refs/heads/cafe123",
+		},
+		{
+			"tag from origin",
+			mustInfoFromOrigin(t, &Origin{URL: "https://github.com/a/b", Ref: "refs/tags/v2"}),
+			"refs/tags/v2",
+		},
+	} {
+		got := test.info.Ref(FullRef)
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, got, test.want)
+		}
+		// The kind survives a round trip through the database.
+		data, err := json.Marshal(test.info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info Info
+		if err := json.Unmarshal(data, &info); err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Ref(FullRef); got != test.want {
+			t.Errorf("%s: after JSON round trip: got %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func mustModuleInfo(t *testing.T, modulePath, version string) *Info {
+	t.Helper()
+	info, err := ModuleInfo(context.Background(), nil, modulePath, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func mustInfoFromOrigin(t *testing.T, origin *Origin) *Info {
+	t.Helper()
+	info, err := InfoFromOrigin(origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestRenderedFileLineURLs(t *testing.T) {
+	github := NewGitHubInfo("https://github.com/a/b", "", "v1.0.0")
+	gitlab := NewGitLabInfo("https://gitlab.com/a/b", "", "v1.0.0")
+	bitbucket := &Info{repoURL: "https://bitbucket.org/a/b", commit: "v1.0.0", templates: bitbucketURLTemplates}
+	for _, test := range []struct {
+		desc, got, want string
+	}{
+		{"github rst", github.LineURL("doc/x.rst", 3), "https://github.com/a/b/blob/v1.0.0/doc/x.rst?plain=1#L3"},
+		{"github md range", github.LineRangeURL("README.MD", 3, 5), "https://github.com/a/b/blob/v1.0.0/README.MD?plain=1#L3-L5"},
+		{"github go", github.LineURL("x.go", 3), "https://github.com/a/b/blob/v1.0.0/x.go#L3"},
+		{"github rst file", github.FileURL("doc/x.rst"), "https://github.com/a/b/blob/v1.0.0/doc/x.rst"},
+		{"gitlab rst", gitlab.LineURL("doc/x.rst", 3), "https://gitlab.com/a/b/blob/v1.0.0/doc/x.rst?plain=1#L3"},
+		{"gitlab adoc range", gitlab.LineRangeURL("x.adoc", 3, 5), "https://gitlab.com/a/b/blob/v1.0.0/x.adoc?plain=1#L3-5"},
+		{"bitbucket rst", bitbucket.LineURL("doc/x.rst", 3), "https://bitbucket.org/a/b/src/v1.0.0/doc/x.rst#lines-3"},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, test.got, test.want)
+		}
+	}
+}
+
+func TestTemplateVars(t *testing.T) {
+	info := NewGitHubInfo("https://github.com/a/b", "sub", "sub/v1.0.0")
+	got := info.TemplateVars("c d/f.go", 12)
+	want := map[string]string{
+		"repo":   "https://github.com/a/b",
+		"commit": "sub/v1.0.0",
+		"dir":    "sub/c%20d/f.go",
+		"file":   "sub/c%20d/f.go",
+		"line":   "12",
+		"owner":  "a",
+		"name":   "b",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+	// The variables build the same URLs as the Info.
+	if u, want := expand(githubURLTemplates.Line, got), info.LineURL("c d/f.go", 12); u != want {
+		t.Errorf("got %q, want %q", u, want)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sourcetest provides source.Info values for tests of code that
+// renders links to source. The values are built from the patterns of
+// package source for well-known hosting sites, without network access, so
+// they are deterministic.
+package sourcetest
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"golang.org/x/pkgsite/internal/source"
+)
+
+// modulePaths holds the path of a module at the root of a repo on each
+// hosting site.
+var modulePaths = map[string]string{
+	"github":       "github.com/owner/repo",
+	"gitlab":       "gitlab.com/owner/repo",
+	"bitbucket":    "bitbucket.org/owner/repo",
+	"googlesource": "go.googlesource.com/repo.git",
+	"sourcehut":    "git.sr.ht/~owner/repo",
+}
+
+// Hosts lists the hosting sites that Info supports.
+var Hosts = []string{"bitbucket", "github", "gitlab", "googlesource", "sourcehut"}
+
+// Info returns an Info for a module in the directory moduleDir of a repo on
+// the given hosting site, whose URLs refer to commit, which may be a tag. The
+// repo's URL is like "https://github.com/owner/repo". Info panics if host is
+// not in Hosts.
+func Info(host, moduleDir, commit string) *source.Info {
+	modulePath, ok := modulePaths[host]
+	if !ok {
+		panic(fmt.Sprintf("sourcetest.Info: unknown host %q", host))
+	}
+	if moduleDir != "" {
+		modulePath = path.Join(modulePath, moduleDir)
+	}
+	info, err := source.InfoAtCommit(context.Background(), nil, modulePath, commit)
+	if err != nil {
+		panic(fmt.Sprintf("sourcetest.Info(%q, %q, %q): %v", host, moduleDir, commit, err))
+	}
+	return info
+}
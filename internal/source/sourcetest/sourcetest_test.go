@@ -0,0 +1,35 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sourcetest
+
+import "testing"
+
+func TestInfo(t *testing.T) {
+	for _, test := range []struct {
+		host, wantRepo, wantFile string
+	}{
+		{"bitbucket", "https://bitbucket.org/owner/repo", "https://bitbucket.org/owner/repo/src/v1.0.0/sub/f.go"},
+		{"github", "https://github.com/owner/repo", "https://github.com/owner/repo/blob/v1.0.0/sub/f.go"},
+		{"gitlab", "https://gitlab.com/owner/repo", "https://gitlab.com/owner/repo/blob/v1.0.0/sub/f.go"},
+		{"googlesource", "https://go.googlesource.com/repo", "https://go.googlesource.com/repo/+/v1.0.0/sub/f.go"},
+		{"sourcehut", "https://git.sr.ht/~owner/repo", "https://git.sr.ht/~owner/repo/tree/v1.0.0/item/sub/f.go"},
+	} {
+		info := Info(test.host, "sub", "v1.0.0")
+		if got := info.RepoURL(); got != test.wantRepo {
+			t.Errorf("%s: RepoURL: got %q, want %q", test.host, got, test.wantRepo)
+		}
+		if got := info.FileURL("f.go"); got != test.wantFile {
+			t.Errorf("%s: FileURL: got %q, want %q", test.host, got, test.wantFile)
+		}
+	}
+	if len(Hosts) != len(modulePaths) {
+		t.Errorf("Hosts has %d elements, want %d", len(Hosts), len(modulePaths))
+	}
+	for _, h := range Hosts {
+		if _, ok := modulePaths[h]; !ok {
+			t.Errorf("no module path for %q", h)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// A ResolutionTrace records the steps taken to determine the source
+// information of a module, for debugging.
+type ResolutionTrace struct {
+	mu    sync.Mutex
+	steps []TraceStep
+}
+
+// A TraceStep is one step of a ResolutionTrace.
+type TraceStep struct {
+	// Kind is one of
+	//   "pattern"   a pattern matched the module path
+	//   "fetch"     an HTTP request was made
+	//   "redirect"  a request was redirected
+	//   "meta"      meta tags were found
+	//   "cached"    meta tags were found in the cache of a Resolver
+	//   "hint"      meta tag information came from Options.RepoHint
+	//   "templates" URL templates were chosen
+	Kind   string
+	Detail string
+}
+
+// Steps returns the steps recorded in t.
+func (t *ResolutionTrace) Steps() []TraceStep {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TraceStep(nil), t.steps...)
+}
+
+// add records a step in t, which may be nil.
+func (t *ResolutionTrace) add(kind, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = append(t.steps, TraceStep{Kind: kind, Detail: fmt.Sprintf(format, args...)})
+}
+
+type traceKey struct{}
+
+// WithResolutionTrace returns a context that causes the functions of this
+// package that are passed it to record their steps in t.
+func WithResolutionTrace(ctx context.Context, t *ResolutionTrace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// traceFrom returns the trace of ctx, or nil if there is none.
+func traceFrom(ctx context.Context) *ResolutionTrace {
+	t, _ := ctx.Value(traceKey{}).(*ResolutionTrace)
+	return t
+}
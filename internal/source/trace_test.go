@@ -0,0 +1,43 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResolutionTrace(t *testing.T) {
+	client := NewClient(testTimeout)
+	client.httpClient.Transport = testTransport(testWeb)
+
+	var tr ResolutionTrace
+	ctx := WithResolutionTrace(context.Background(), &tr)
+	if _, err := ModuleInfo(ctx, client, "alice.org/pkg", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	want := []TraceStep{
+		{"fetch", "GET https://alice.org/pkg?go-get=1"},
+		{"meta", `repo root "alice.org/pkg", repo URL "https://github.com/alice/pkg"`},
+		{"templates", "github"},
+	}
+	if diff := cmp.Diff(want, tr.Steps()); diff != "" {
+		t.Errorf("dynamic: mismatch (-want +got):\n%s", diff)
+	}
+
+	tr = ResolutionTrace{}
+	if _, err := ModuleInfo(ctx, client, "github.com/a/b", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	want = []TraceStep{
+		{"pattern", `github.com/a/b matches repo "github.com/a/b"`},
+		{"templates", "github"},
+	}
+	if diff := cmp.Diff(want, tr.Steps()); diff != "" {
+		t.Errorf("static: mismatch (-want +got):\n%s", diff)
+	}
+}